@@ -0,0 +1,439 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"flag"
+	"fmt"
+	"os"
+	"strings"
+	"time"
+
+	corev1 "k8s.io/api/core/v1"
+	apierrors "k8s.io/apimachinery/pkg/api/errors"
+	"k8s.io/apimachinery/pkg/labels"
+	"k8s.io/apimachinery/pkg/types"
+	"k8s.io/client-go/rest"
+	"sigs.k8s.io/controller-runtime/pkg/client"
+
+	"github.com/OrRener/service-account-token-operator/internal/controller"
+)
+
+// parseArgs allows flags after the positional arguments, e.g. `describe my-sa -n my-namespace`.
+func parseArgs(fs *flag.FlagSet, args []string) ([]string, error) {
+	var positional []string
+
+	for {
+		if err := fs.Parse(args); err != nil {
+			return nil, err
+		}
+
+		if fs.NArg() == 0 {
+			return positional, nil
+		}
+
+		positional = append(positional, fs.Arg(0))
+		args = fs.Args()[1:]
+	}
+}
+
+func singleName(command string, args []string) (string, error) {
+	if len(args) != 1 {
+		return "", fmt.Errorf("%s expects exactly one service account name, got %d", command, len(args))
+	}
+
+	return args[0], nil
+}
+
+func listManaged(ctx context.Context, c client.Client, opts *options) ([]corev1.ServiceAccount, error) {
+	var listOpts []client.ListOption
+	if !opts.allNamespaces {
+		listOpts = append(listOpts, client.InNamespace(opts.namespace))
+	}
+	if opts.selector != "" {
+		selector, err := labels.Parse(opts.selector)
+		if err != nil {
+			return nil, fmt.Errorf("invalid selector %q: %w", opts.selector, err)
+		}
+		listOpts = append(listOpts, client.MatchingLabelsSelector{Selector: selector})
+	}
+
+	saList := &corev1.ServiceAccountList{}
+	if err := c.List(ctx, saList, listOpts...); err != nil {
+		return nil, err
+	}
+
+	var managed []corev1.ServiceAccount
+	for _, sa := range saList.Items {
+		if controller.ManagementMode(sa.Annotations) != "" {
+			managed = append(managed, sa)
+		}
+	}
+
+	return managed, nil
+}
+
+func getManaged(ctx context.Context, c client.Client, namespace, name string) (*corev1.ServiceAccount, error) {
+	sa := &corev1.ServiceAccount{}
+	if err := c.Get(ctx, types.NamespacedName{Namespace: namespace, Name: name}, sa); err != nil {
+		return nil, err
+	}
+
+	if controller.ManagementMode(sa.Annotations) == "" {
+		return nil, fmt.Errorf("service account %s/%s is not managed by the operator", namespace, name)
+	}
+
+	return sa, nil
+}
+
+func getSecret(ctx context.Context, c client.Client, namespace, name string) (*corev1.Secret, error) {
+	secret := &corev1.Secret{}
+	if err := c.Get(ctx, types.NamespacedName{Namespace: namespace, Name: name}, secret); err != nil {
+		if apierrors.IsNotFound(err) {
+			return nil, nil
+		}
+		return nil, err
+	}
+
+	return secret, nil
+}
+
+func getTokenSecret(ctx context.Context, c client.Client, sa *corev1.ServiceAccount) (*corev1.Secret, error) {
+	return getSecret(ctx, c, sa.Namespace, controller.TokenSecretName(sa.Name))
+}
+
+// getNamedTokenSecrets leaves out the secrets that do not exist.
+func getNamedTokenSecrets(ctx context.Context, c client.Client, sa *corev1.ServiceAccount) (map[string]*corev1.Secret, error) {
+	secrets := map[string]*corev1.Secret{}
+	for _, name := range controller.NamedTokenSecretNames(sa) {
+		secret, err := getSecret(ctx, c, sa.Namespace, name)
+		if err != nil {
+			return nil, err
+		}
+		if secret != nil {
+			secrets[name] = secret
+		}
+	}
+
+	return secrets, nil
+}
+
+func runList(ctx context.Context, args []string) error {
+	opts := &options{}
+	fs := flag.NewFlagSet("list", flag.ExitOnError)
+	opts.bindFlags(fs, true)
+	fs.BoolVar(&opts.allNamespaces, "A", false, "List managed service accounts across all namespaces.")
+	fs.BoolVar(&opts.allNamespaces, "all-namespaces", false, "List managed service accounts across all namespaces.")
+	if _, err := parseArgs(fs, args); err != nil {
+		return err
+	}
+
+	c, _, err := opts.connect()
+	if err != nil {
+		return err
+	}
+
+	managed, err := listManaged(ctx, c, opts)
+	if err != nil {
+		return err
+	}
+
+	statuses := make([]controller.TokenStatus, 0, len(managed))
+	for i := range managed {
+		statuses = append(statuses, controller.Inspect(&managed[i]))
+	}
+
+	rows := make([][]string, 0, len(statuses))
+	for _, s := range statuses {
+		rows = append(rows, []string{s.Namespace, s.Name, s.Mode, orNone(s.Expiration), orNone(s.LastRenewal)})
+	}
+
+	return printOutput(opts.output, statuses, []string{"NAMESPACE", "NAME", "MODE", "EXPIRATION", "LAST RENEWAL"}, rows)
+}
+
+type description struct {
+	controller.TokenStatus
+	SecretExists bool     `json:"secretExists"`
+	SecretType   string   `json:"secretType,omitempty"`
+	Plan         []string `json:"plan"`
+}
+
+func runDescribe(ctx context.Context, args []string) error {
+	opts := &options{}
+	fs := flag.NewFlagSet("describe", flag.ExitOnError)
+	opts.bindFlags(fs, true)
+	positional, err := parseArgs(fs, args)
+	if err != nil {
+		return err
+	}
+
+	name, err := singleName("describe", positional)
+	if err != nil {
+		return err
+	}
+
+	c, _, err := opts.connect()
+	if err != nil {
+		return err
+	}
+
+	sa, err := getManaged(ctx, c, opts.namespace, name)
+	if err != nil {
+		return err
+	}
+
+	secret, err := getTokenSecret(ctx, c, sa)
+	if err != nil {
+		return err
+	}
+
+	namedSecrets, err := getNamedTokenSecrets(ctx, c, sa)
+	if err != nil {
+		return err
+	}
+
+	plan, err := controller.Plan(sa, secret, namedSecrets)
+	if err != nil {
+		return fmt.Errorf("failed to compute plan: %w", err)
+	}
+
+	desc := description{TokenStatus: controller.Inspect(sa), Plan: plan}
+	if secret != nil {
+		desc.SecretExists = true
+		desc.SecretType = string(secret.Type)
+	}
+
+	rows := [][]string{
+		{"Namespace:", desc.Namespace},
+		{"Name:", desc.Name},
+		{"Mode:", desc.Mode},
+		{"Mode conflict:", fmt.Sprint(desc.ModeConflict)},
+		{"Secret:", secretRow(desc.Secret, secret)},
+		{"Named tokens:", orNone(strings.Join(desc.NamedTokens, ", "))},
+		{"Renew after:", orNone(desc.RenewAfter)},
+		{"Expiration:", orNone(desc.Expiration)},
+		{"Last renewal:", orNone(desc.LastRenewal)},
+		{"Rotation pending:", fmt.Sprint(desc.RotationPending)},
+		{"Suspended:", fmt.Sprint(desc.Suspended)},
+		{"Status:", orNone(desc.Status)},
+		{"Plan:", planSummary(plan)},
+	}
+
+	return printOutput(opts.output, desc, nil, rows)
+}
+
+func runRotate(ctx context.Context, args []string) error {
+	opts := &options{}
+	fs := flag.NewFlagSet("rotate", flag.ExitOnError)
+	opts.bindFlags(fs, false)
+	positional, err := parseArgs(fs, args)
+	if err != nil {
+		return err
+	}
+
+	name, err := singleName("rotate", positional)
+	if err != nil {
+		return err
+	}
+
+	c, _, err := opts.connect()
+	if err != nil {
+		return err
+	}
+
+	sa, err := getManaged(ctx, c, opts.namespace, name)
+	if err != nil {
+		return err
+	}
+
+	patch := client.MergeFrom(sa.DeepCopy())
+	sa.Annotations[controller.RotateAnnotation] = time.Now().UTC().Format(time.RFC3339Nano)
+	if err := c.Patch(ctx, sa, patch); err != nil {
+		return err
+	}
+
+	fmt.Fprintf(os.Stdout, "rotation of the %s token of service account %s/%s requested\n", controller.ManagementMode(sa.Annotations), sa.Namespace, sa.Name)
+
+	return nil
+}
+
+func runSuspend(ctx context.Context, args []string) error {
+	return setSuspended(ctx, "suspend", args, true)
+}
+
+func runResume(ctx context.Context, args []string) error {
+	return setSuspended(ctx, "resume", args, false)
+}
+
+func setSuspended(ctx context.Context, command string, args []string, suspend bool) error {
+	opts := &options{}
+	fs := flag.NewFlagSet(command, flag.ExitOnError)
+	opts.bindFlags(fs, false)
+	positional, err := parseArgs(fs, args)
+	if err != nil {
+		return err
+	}
+
+	name, err := singleName(command, positional)
+	if err != nil {
+		return err
+	}
+
+	c, _, err := opts.connect()
+	if err != nil {
+		return err
+	}
+
+	sa, err := getManaged(ctx, c, opts.namespace, name)
+	if err != nil {
+		return err
+	}
+
+	patch := client.MergeFrom(sa.DeepCopy())
+	if suspend {
+		sa.Annotations[controller.SuspendAnnotation] = "true"
+	} else {
+		delete(sa.Annotations, controller.SuspendAnnotation)
+	}
+	if err := c.Patch(ctx, sa, patch); err != nil {
+		return err
+	}
+
+	fmt.Fprintf(os.Stdout, "%s of service account %s/%s requested\n", command, sa.Namespace, sa.Name)
+
+	return nil
+}
+
+func runKubeconfig(ctx context.Context, args []string) error {
+	opts := &options{}
+	var server string
+	fs := flag.NewFlagSet("kubeconfig", flag.ExitOnError)
+	opts.bindFlags(fs, false)
+	fs.StringVar(&server, "server", "", "The API server URL to put in the kubeconfig, defaults to the server of the current context.")
+	positional, err := parseArgs(fs, args)
+	if err != nil {
+		return err
+	}
+
+	name, err := singleName("kubeconfig", positional)
+	if err != nil {
+		return err
+	}
+
+	c, restConfig, err := opts.connect()
+	if err != nil {
+		return err
+	}
+
+	sa, err := getManaged(ctx, c, opts.namespace, name)
+	if err != nil {
+		return err
+	}
+
+	secret, err := getTokenSecret(ctx, c, sa)
+	if err != nil {
+		return err
+	}
+
+	if secret == nil || len(secret.Data["token"]) == 0 {
+		return fmt.Errorf("secret %s/%s does not hold a token yet", sa.Namespace, controller.TokenSecretName(sa.Name))
+	}
+
+	if server == "" {
+		server = restConfig.Host
+	}
+
+	caData, err := clusterCA(secret, restConfig)
+	if err != nil {
+		return err
+	}
+
+	out, err := controller.RenderKubeconfig(server, caData, sa.Namespace, sa.Name, string(secret.Data["token"]))
+	if err != nil {
+		return err
+	}
+
+	_, err = os.Stdout.Write(out)
+	return err
+}
+
+// clusterCA prefers the CA stored next to the token and falls back to the one of the current context.
+func clusterCA(secret *corev1.Secret, restConfig *rest.Config) ([]byte, error) {
+	if ca := secret.Data["ca.crt"]; len(ca) > 0 {
+		return ca, nil
+	}
+
+	return controller.ClusterCA(restConfig)
+}
+
+type planEntry struct {
+	Namespace string   `json:"namespace"`
+	Name      string   `json:"name"`
+	Mode      string   `json:"mode"`
+	Actions   []string `json:"actions"`
+	Error     string   `json:"error,omitempty"`
+}
+
+func runPlan(ctx context.Context, args []string) error {
+	opts := &options{}
+	fs := flag.NewFlagSet("plan", flag.ExitOnError)
+	opts.bindFlags(fs, true)
+	fs.BoolVar(&opts.allNamespaces, "A", false, "Plan for managed service accounts across all namespaces.")
+	fs.BoolVar(&opts.allNamespaces, "all-namespaces", false, "Plan for managed service accounts across all namespaces.")
+	positional, err := parseArgs(fs, args)
+	if err != nil {
+		return err
+	}
+
+	if len(positional) > 1 {
+		return errors.New("plan expects at most one service account name")
+	}
+
+	c, _, err := opts.connect()
+	if err != nil {
+		return err
+	}
+
+	var managed []corev1.ServiceAccount
+	if len(positional) == 1 {
+		sa, err := getManaged(ctx, c, opts.namespace, positional[0])
+		if err != nil {
+			return err
+		}
+		managed = append(managed, *sa)
+	} else {
+		managed, err = listManaged(ctx, c, opts)
+		if err != nil {
+			return err
+		}
+	}
+
+	entries := make([]planEntry, 0, len(managed))
+	rows := make([][]string, 0, len(managed))
+	for i := range managed {
+		sa := &managed[i]
+		entry := planEntry{Namespace: sa.Namespace, Name: sa.Name, Mode: controller.ManagementMode(sa.Annotations)}
+
+		secret, err := getTokenSecret(ctx, c, sa)
+		var namedSecrets map[string]*corev1.Secret
+		if err == nil {
+			namedSecrets, err = getNamedTokenSecrets(ctx, c, sa)
+		}
+		if err == nil {
+			entry.Actions, err = controller.Plan(sa, secret, namedSecrets)
+		}
+		if err != nil {
+			entry.Error = err.Error()
+		}
+
+		summary := planSummary(entry.Actions)
+		if entry.Error != "" {
+			summary = fmt.Sprintf("error: %s", entry.Error)
+		}
+
+		entries = append(entries, entry)
+		rows = append(rows, []string{entry.Namespace, entry.Name, entry.Mode, summary})
+	}
+
+	return printOutput(opts.output, entries, []string{"NAMESPACE", "NAME", "MODE", "PLAN"}, rows)
+}
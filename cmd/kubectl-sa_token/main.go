@@ -0,0 +1,127 @@
+package main
+
+import (
+	"context"
+	"flag"
+	"fmt"
+	"os"
+
+	corev1 "k8s.io/api/core/v1"
+	"k8s.io/apimachinery/pkg/runtime"
+	utilruntime "k8s.io/apimachinery/pkg/util/runtime"
+	"k8s.io/client-go/rest"
+	"k8s.io/client-go/tools/clientcmd"
+	"sigs.k8s.io/controller-runtime/pkg/client"
+)
+
+const usage = `kubectl sa-token inspects and operates service account tokens managed by the service-account-token-operator.
+
+Usage:
+  kubectl sa-token <command> [flags]
+
+Commands:
+  list                  list managed service accounts with their mode, expiration and last renewal
+  describe <name>       show the token state of a managed service account
+  rotate <name>         ask the operator to rotate the token of a managed service account
+  rotate-all            rotate the tokens of all the selected managed service accounts and report the outcome
+  suspend <name>        freeze the token of a managed service account
+  resume <name>         resume managing the token of a suspended service account
+  kubeconfig <name>     render a kubeconfig from the managed token secret
+  plan [name]           show what the operator would change on its next reconciliation
+
+Run 'kubectl sa-token <command> -h' for the flags of a command.
+`
+
+var scheme = runtime.NewScheme()
+
+func init() {
+	utilruntime.Must(corev1.AddToScheme(scheme))
+}
+
+type options struct {
+	namespace     string
+	allNamespaces bool
+	selector      string
+	output        string
+	kubeconfig    string
+	context       string
+}
+
+func (o *options) bindFlags(fs *flag.FlagSet, withOutput bool) {
+	fs.StringVar(&o.namespace, "n", "", "The namespace of the service account(s), defaults to the namespace of the current context.")
+	fs.StringVar(&o.namespace, "namespace", "", "The namespace of the service account(s), defaults to the namespace of the current context.")
+	fs.StringVar(&o.kubeconfig, "kubeconfig", "", "Path to the kubeconfig file to use.")
+	fs.StringVar(&o.context, "context", "", "The kubeconfig context to use.")
+	if withOutput {
+		fs.StringVar(&o.output, "o", "table", "Output format, one of: table, json, yaml.")
+		fs.StringVar(&o.output, "output", "table", "Output format, one of: table, json, yaml.")
+	}
+}
+
+func (o *options) clientConfig() clientcmd.ClientConfig {
+	loadingRules := clientcmd.NewDefaultClientConfigLoadingRules()
+	loadingRules.ExplicitPath = o.kubeconfig
+
+	return clientcmd.NewNonInteractiveDeferredLoadingClientConfig(loadingRules, &clientcmd.ConfigOverrides{
+		CurrentContext: o.context,
+	})
+}
+
+func (o *options) connect() (client.Client, *rest.Config, error) {
+	clientConfig := o.clientConfig()
+
+	if o.namespace == "" {
+		namespace, _, err := clientConfig.Namespace()
+		if err != nil {
+			return nil, nil, err
+		}
+		o.namespace = namespace
+	}
+
+	restConfig, err := clientConfig.ClientConfig()
+	if err != nil {
+		return nil, nil, err
+	}
+
+	c, err := client.New(restConfig, client.Options{Scheme: scheme})
+	if err != nil {
+		return nil, nil, err
+	}
+
+	return c, restConfig, nil
+}
+
+func main() {
+	if len(os.Args) < 2 {
+		fmt.Fprint(os.Stderr, usage)
+		os.Exit(2)
+	}
+
+	commands := map[string]func(context.Context, []string) error{
+		"list":       runList,
+		"describe":   runDescribe,
+		"rotate":     runRotate,
+		"rotate-all": runRotateAll,
+		"suspend":    runSuspend,
+		"resume":     runResume,
+		"kubeconfig": runKubeconfig,
+		"plan":       runPlan,
+	}
+
+	name := os.Args[1]
+	if name == "-h" || name == "--help" || name == "help" {
+		fmt.Fprint(os.Stdout, usage)
+		return
+	}
+
+	run, ok := commands[name]
+	if !ok {
+		fmt.Fprintf(os.Stderr, "unknown command %q\n\n%s", name, usage)
+		os.Exit(2)
+	}
+
+	if err := run(context.Background(), os.Args[2:]); err != nil {
+		fmt.Fprintf(os.Stderr, "error: %v\n", err)
+		os.Exit(1)
+	}
+}
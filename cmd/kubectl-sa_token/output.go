@@ -0,0 +1,71 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"os"
+	"strings"
+	"text/tabwriter"
+
+	corev1 "k8s.io/api/core/v1"
+	"sigs.k8s.io/yaml"
+)
+
+// printOutput writes obj as json or yaml, or the rows as a table when the output format is table.
+func printOutput(output string, obj any, header []string, rows [][]string) error {
+	switch output {
+	case "json":
+		out, err := json.MarshalIndent(obj, "", "  ")
+		if err != nil {
+			return err
+		}
+		fmt.Fprintln(os.Stdout, string(out))
+	case "yaml":
+		out, err := yaml.Marshal(obj)
+		if err != nil {
+			return err
+		}
+		fmt.Fprint(os.Stdout, string(out))
+	case "table", "":
+		w := tabwriter.NewWriter(os.Stdout, 0, 4, 3, ' ', 0)
+		if header != nil {
+			fmt.Fprintln(w, strings.Join(header, "\t"))
+		}
+		for _, row := range rows {
+			fmt.Fprintln(w, strings.Join(row, "\t"))
+		}
+		return w.Flush()
+	default:
+		return fmt.Errorf("unknown output format %q, must be one of: table, json, yaml", output)
+	}
+
+	return nil
+}
+
+func orNone(val string) string {
+	if val == "" {
+		return "<none>"
+	}
+	return val
+}
+
+func planSummary(actions []string) string {
+	if len(actions) == 0 {
+		return "up to date"
+	}
+	return strings.Join(actions, ", ")
+}
+
+func secretState(secret *corev1.Secret) string {
+	if secret == nil {
+		return "missing"
+	}
+	return string(secret.Type)
+}
+
+func secretRow(name string, secret *corev1.Secret) string {
+	if name == "" {
+		return "<none>"
+	}
+	return fmt.Sprintf("%s (%s)", name, secretState(secret))
+}
@@ -0,0 +1,260 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"flag"
+	"fmt"
+	"os"
+	"sync"
+	"time"
+
+	corev1 "k8s.io/api/core/v1"
+	apierrors "k8s.io/apimachinery/pkg/api/errors"
+	"k8s.io/apimachinery/pkg/types"
+	"k8s.io/apimachinery/pkg/util/wait"
+	"sigs.k8s.io/controller-runtime/pkg/client"
+
+	"github.com/OrRener/service-account-token-operator/internal/controller"
+)
+
+// Outcomes of the rotation of a service account.
+const (
+	rotationRotated = "rotated"
+	// bound tokens cannot be revoked, the previous ones stay valid until they expire
+	rotationReissued  = "reissued, not revoked"
+	rotationRequested = "requested"
+	rotationDryRun    = "would rotate"
+	rotationSkipped   = "skipped"
+	rotationFailed    = "failed"
+	rotationTimedOut  = "timed out"
+)
+
+const rotationPollInterval = 2 * time.Second
+
+type rotationResult struct {
+	Namespace                string `json:"namespace"`
+	Name                     string `json:"name"`
+	Mode                     string `json:"mode"`
+	Result                   string `json:"result"`
+	Duration                 string `json:"duration,omitempty"`
+	PreviousTokensValidUntil string `json:"previousTokensValidUntil,omitempty"`
+	Error                    string `json:"error,omitempty"`
+}
+
+type rotationReport struct {
+	Requested string           `json:"requested"`
+	Rotated   int              `json:"rotated"`
+	Reissued  int              `json:"reissued"`
+	Skipped   int              `json:"skipped"`
+	Failed    int              `json:"failed"`
+	Results   []rotationResult `json:"results"`
+}
+
+type rotateAllOptions struct {
+	parallelism int
+	wait        bool
+	timeout     time.Duration
+	dryRun      bool
+}
+
+// runRotateAll sets the rotation trigger on every selected service account and waits for the operator.
+func runRotateAll(ctx context.Context, args []string) error {
+	opts := &options{}
+	rotateOpts := &rotateAllOptions{}
+	fs := flag.NewFlagSet("rotate-all", flag.ExitOnError)
+	opts.bindFlags(fs, true)
+	fs.BoolVar(&opts.allNamespaces, "A", false, "Rotate managed service accounts across all namespaces.")
+	fs.BoolVar(&opts.allNamespaces, "all-namespaces", false, "Rotate managed service accounts across all namespaces.")
+	fs.StringVar(&opts.selector, "l", "", "Label selector of the service accounts to rotate.")
+	fs.StringVar(&opts.selector, "selector", "", "Label selector of the service accounts to rotate.")
+	fs.IntVar(&rotateOpts.parallelism, "parallelism", 10, "The number of service accounts rotated at the same time.")
+	fs.BoolVar(&rotateOpts.wait, "wait", true, "Wait for the operator to rotate each token.")
+	fs.DurationVar(&rotateOpts.timeout, "timeout", 5*time.Minute, "How long to wait for the rotation of each service account.")
+	fs.BoolVar(&rotateOpts.dryRun, "dry-run", false, "Only list the service accounts that would be rotated.")
+	positional, err := parseArgs(fs, args)
+	if err != nil {
+		return err
+	}
+
+	if len(positional) > 0 {
+		return errors.New("rotate-all does not take service account names, select them with -n, -A and -l")
+	}
+	if rotateOpts.parallelism < 1 {
+		return fmt.Errorf("--parallelism must be at least 1, got %d", rotateOpts.parallelism)
+	}
+
+	c, _, err := opts.connect()
+	if err != nil {
+		return err
+	}
+
+	managed, err := listManaged(ctx, c, opts)
+	if err != nil {
+		return err
+	}
+
+	// a value never used before, so a rotation requested a moment ago is rotated again
+	report := rotateAll(ctx, c, managed, rotateOpts, time.Now().UTC().Format(time.RFC3339Nano))
+
+	rows := make([][]string, 0, len(report.Results))
+	for _, r := range report.Results {
+		rows = append(rows, []string{r.Namespace, r.Name, r.Mode, r.Result, orNone(r.PreviousTokensValidUntil), orNone(r.Duration), orNone(r.Error)})
+	}
+	if err := printOutput(opts.output, report, []string{"NAMESPACE", "NAME", "MODE", "RESULT", "PREVIOUS TOKENS VALID UNTIL", "DURATION", "ERROR"}, rows); err != nil {
+		return err
+	}
+
+	fmt.Fprintf(os.Stderr, "%d service account(s) selected: %d rotated, %d reissued, %d skipped, %d failed\n",
+		len(report.Results), report.Rotated, report.Reissued, report.Skipped, report.Failed)
+	if report.Reissued > 0 {
+		fmt.Fprintln(os.Stderr, "the bound tokens issued before the rotation were not revoked, they stay valid until they expire (recreate a service account to revoke them)")
+	}
+	if report.Failed > 0 {
+		return fmt.Errorf("the rotation of %d service account(s) failed", report.Failed)
+	}
+
+	return nil
+}
+
+// rotateAll keeps the order of the service accounts in the results.
+func rotateAll(ctx context.Context, c client.Client, managed []corev1.ServiceAccount, opts *rotateAllOptions, value string) rotationReport {
+	report := rotationReport{Requested: value, Results: make([]rotationResult, len(managed))}
+
+	var (
+		wg       sync.WaitGroup
+		mu       sync.Mutex
+		done     int
+		inFlight = make(chan struct{}, opts.parallelism)
+	)
+	for i := range managed {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			inFlight <- struct{}{}
+			defer func() { <-inFlight }()
+
+			result := rotateOne(ctx, c, &managed[i], opts, value)
+			report.Results[i] = result
+
+			mu.Lock()
+			defer mu.Unlock()
+			done++
+			switch result.Result {
+			case rotationRotated, rotationRequested:
+				report.Rotated++
+			case rotationReissued:
+				report.Reissued++
+			case rotationSkipped, rotationDryRun:
+				report.Skipped++
+			default:
+				report.Failed++
+			}
+			fmt.Fprintf(os.Stderr, "[%d/%d] %s/%s: %s\n", done, len(managed), result.Namespace, result.Name, result.Result)
+		}()
+	}
+	wg.Wait()
+
+	return report
+}
+
+func rotateOne(ctx context.Context, c client.Client, sa *corev1.ServiceAccount, opts *rotateAllOptions, value string) rotationResult {
+	result := rotationResult{Namespace: sa.Namespace, Name: sa.Name, Mode: controller.ManagementMode(sa.Annotations)}
+	failed := func(state string, err error) rotationResult {
+		result.Result = state
+		result.Error = err.Error()
+		return result
+	}
+
+	// the operator does not touch suspended service accounts, waiting for them would only time out
+	if controller.Inspect(sa).Suspended {
+		return failed(rotationSkipped, errors.New("management is suspended"))
+	}
+
+	previous, err := previousTokensExpiration(ctx, c, sa)
+	if err != nil {
+		return failed(rotationFailed, err)
+	}
+	if !previous.IsZero() {
+		result.PreviousTokensValidUntil = previous.Format(time.RFC3339)
+	}
+
+	if opts.dryRun {
+		result.Result = rotationDryRun
+		return result
+	}
+
+	start := time.Now()
+	patch := client.MergeFrom(sa.DeepCopy())
+	sa.Annotations[controller.RotateAnnotation] = value
+	if err := c.Patch(ctx, sa, patch); err != nil {
+		return failed(rotationFailed, err)
+	}
+
+	if !opts.wait {
+		result.Result = rotationRequested
+		return result
+	}
+
+	key := types.NamespacedName{Namespace: sa.Namespace, Name: sa.Name}
+	var status controller.TokenStatus
+	err = wait.PollUntilContextTimeout(ctx, rotationPollInterval, opts.timeout, true, func(ctx context.Context) (bool, error) {
+		current := &corev1.ServiceAccount{}
+		if err := c.Get(ctx, key, current); err != nil {
+			// the service account was deleted, there is no token left to rotate
+			if apierrors.IsNotFound(err) {
+				return false, err
+			}
+			return false, nil
+		}
+
+		status = controller.Inspect(current)
+		return !status.RotationPending, nil
+	})
+	result.Duration = time.Since(start).Round(time.Second).String()
+
+	switch {
+	case apierrors.IsNotFound(err):
+		return failed(rotationSkipped, errors.New("the service account was deleted"))
+	case wait.Interrupted(err):
+		if status.Status != "" {
+			return failed(rotationTimedOut, errors.New(status.Status))
+		}
+		return failed(rotationTimedOut, fmt.Errorf("the operator did not rotate the token within %s", opts.timeout))
+	case err != nil:
+		return failed(rotationFailed, err)
+	}
+
+	result.Result = rotationRotated
+	if !previous.IsZero() {
+		result.Result = rotationReissued
+	}
+	return result
+}
+
+// previousTokensExpiration is zero when the service account has no bound token.
+func previousTokensExpiration(ctx context.Context, c client.Client, sa *corev1.ServiceAccount) (time.Time, error) {
+	var latest time.Time
+	add := func(annotations map[string]string) {
+		if expiration, ok := controller.TokenExpiration(annotations); ok && expiration.After(latest) {
+			latest = expiration
+		}
+	}
+
+	if controller.ManagementMode(sa.Annotations) == controller.ModeRenewal {
+		add(sa.Annotations)
+	}
+
+	for _, name := range controller.NamedTokenSecretNames(sa) {
+		secret := &corev1.Secret{}
+		if err := c.Get(ctx, types.NamespacedName{Namespace: sa.Namespace, Name: name}, secret); err != nil {
+			if apierrors.IsNotFound(err) {
+				continue
+			}
+			return time.Time{}, err
+		}
+		add(secret.Annotations)
+	}
+
+	return latest, nil
+}
@@ -21,12 +21,14 @@ import (
 	"flag"
 	"os"
 	"path/filepath"
+	"time"
 
 	// Import all Kubernetes client auth plugins (e.g. Azure, GCP, OIDC, etc.)
 	// to ensure that exec-entrypoint and run can make use of them.
 	_ "k8s.io/client-go/plugin/pkg/client/auth"
 
 	"github.com/OrRener/service-account-token-operator/internal/controller"
+	corev1 "k8s.io/api/core/v1"
 	"k8s.io/apimachinery/pkg/runtime"
 	utilruntime "k8s.io/apimachinery/pkg/util/runtime"
 	clientgoscheme "k8s.io/client-go/kubernetes/scheme"
@@ -60,6 +62,16 @@ func main() {
 	var probeAddr string
 	var secureMetrics bool
 	var enableHTTP2 bool
+	var dryRun bool
+	var policyFile string
+	var modeConflictPolicy string
+	var adoptLegacySecrets bool
+	var renewalSecretType string
+	var requireOptInLabel bool
+	var orphanedSecrets string
+	var gcInterval time.Duration
+	var handlerTimeout time.Duration
+	var permissionCheckInterval time.Duration
 	var tlsOpts []func(*tls.Config)
 	flag.StringVar(&metricsAddr, "metrics-bind-address", ":8080", "The address the metrics endpoint binds to. "+
 		"Use :8443 for HTTPS or :8080 for HTTP, or leave as 0 to disable the metrics service.")
@@ -78,6 +90,32 @@ func main() {
 	flag.StringVar(&metricsCertKey, "metrics-cert-key", "tls.key", "The name of the metrics server key file.")
 	flag.BoolVar(&enableHTTP2, "enable-http2", false,
 		"If set, HTTP/2 will be enabled for the metrics and webhook servers")
+	flag.BoolVar(&dryRun, "dry-run", false,
+		"If set, the controller only logs and reports (events and metrics) what it would do, "+
+			"writes are sent as server-side dry-run requests and no tokens are issued.")
+	flag.StringVar(&policyFile, "policy-file", "",
+		"Path to a policy file restricting which service accounts may get which tokens. "+
+			"If not set, every annotated service account is managed.")
+	flag.StringVar(&modeConflictPolicy, "mode-conflict-policy", controller.ConflictPreferLongLived,
+		"What to do with service accounts annotated with both or.io/create-secret and or.io/renew-after, "+
+			"one of: reject, prefer-renewal, prefer-long-lived.")
+	flag.BoolVar(&adoptLegacySecrets, "adopt-legacy-secrets", false,
+		"If set, existing <service-account>-token secrets of type kubernetes.io/service-account-token created "+
+			"for the service account by someone else are adopted instead of being left alone.")
+	flag.StringVar(&renewalSecretType, "renewal-secret-type", string(controller.DefaultRenewalSecretType),
+		"The type of the token secrets written in renewal mode, one of: Opaque, kubernetes.io/service-account-token. "+
+			"Secrets of type kubernetes.io/service-account-token may get a non-expiring token written by the token controller.")
+	flag.BoolVar(&requireOptInLabel, "require-opt-in-label", false,
+		"If set, only service accounts labeled with or.io/managed=true are managed, the others are not even cached.")
+	flag.StringVar(&orphanedSecrets, "orphaned-secrets", controller.OrphanReport,
+		"What to do with managed secrets whose service account is gone, was recreated or is not managed anymore, "+
+			"one of: report, delete.")
+	flag.DurationVar(&gcInterval, "gc-interval", time.Hour,
+		"How often to look for orphaned secrets, 0 disables it.")
+	flag.DurationVar(&handlerTimeout, "handler-timeout", time.Minute,
+		"How long the operator may spend managing the tokens of one service account in one mode, 0 disables it.")
+	flag.DurationVar(&permissionCheckInterval, "permission-check-interval", 5*time.Minute,
+		"How often the operator reviews its permissions, modes missing some are disabled. 0 only reviews them at startup, or until a review succeeds.")
 	opts := zap.Options{
 		Development: true,
 	}
@@ -86,6 +124,22 @@ func main() {
 
 	ctrl.SetLogger(zap.New(zap.UseFlagOptions(&opts)))
 
+	if err := controller.ValidateConflictPolicy(modeConflictPolicy); err != nil {
+		setupLog.Error(err, "invalid flag")
+		os.Exit(1)
+	}
+
+	if err := controller.ValidateOrphanPolicy(orphanedSecrets); err != nil {
+		setupLog.Error(err, "invalid flag")
+		os.Exit(1)
+	}
+
+	if renewalSecretType != string(corev1.SecretTypeOpaque) && renewalSecretType != string(corev1.SecretTypeServiceAccountToken) {
+		setupLog.Error(nil, "invalid flag, --renewal-secret-type must be one of: Opaque, kubernetes.io/service-account-token",
+			"renewal-secret-type", renewalSecretType)
+		os.Exit(1)
+	}
+
 	// if the enable-http2 flag is false (the default), http/2 should be disabled
 	// due to its vulnerabilities. More specifically, disabling http/2 will
 	// prevent from being vulnerable to the HTTP/2 Stream Cancellation and
@@ -175,8 +229,17 @@ func main() {
 		})
 	}
 
-	mgr, err := ctrl.NewManager(ctrl.GetConfigOrDie(), ctrl.Options{
+	restConfig := ctrl.GetConfigOrDie()
+
+	clusterCA, err := controller.ClusterCA(restConfig)
+	if err != nil {
+		setupLog.Error(err, "unable to read the CA bundle of the API server")
+		os.Exit(1)
+	}
+
+	mgr, err := ctrl.NewManager(restConfig, ctrl.Options{
 		Scheme:                 scheme,
+		Cache:                  controller.CacheOptions(requireOptInLabel),
 		Metrics:                metricsServerOptions,
 		WebhookServer:          webhookServer,
 		HealthProbeBindAddress: probeAddr,
@@ -199,14 +262,68 @@ func main() {
 		os.Exit(1)
 	}
 
-	if err = (&controller.ServiceAccountReconciler{
-		Client: mgr.GetClient(),
-		Scheme: mgr.GetScheme(),
-	}).SetupWithManager(mgr); err != nil {
+	var policy *controller.Policy
+	if policyFile != "" {
+		policy, err = controller.LoadPolicy(policyFile)
+		if err != nil {
+			setupLog.Error(err, "unable to load policy")
+			os.Exit(1)
+		}
+	}
+
+	ctx := ctrl.SetupSignalHandler()
+
+	// the permissions are reviewed before the controller starts, then periodically
+	permissions := &controller.PermissionCheck{
+		Client:   mgr.GetClient(),
+		Log:      ctrl.Log.WithName("permissions"),
+		Interval: permissionCheckInterval,
+	}
+	if err := permissions.Run(ctx, mgr.GetClient(), setupLog); err != nil {
+		setupLog.Error(err, "unable to check the permissions of the operator")
+	}
+	if err := mgr.Add(permissions); err != nil {
+		setupLog.Error(err, "unable to add the permission check to manager")
+		os.Exit(1)
+	}
+
+	reconciler := &controller.ServiceAccountReconciler{
+		Client:    mgr.GetClient(),
+		APIReader: mgr.GetAPIReader(),
+		Scheme:    mgr.GetScheme(),
+		Recorder:  mgr.GetEventRecorderFor("service-account-token-operator"),
+		DryRun:    dryRun,
+		Policy:    policy,
+
+		ModeConflictPolicy: modeConflictPolicy,
+		AdoptLegacySecrets: adoptLegacySecrets,
+		RenewalSecretType:  corev1.SecretType(renewalSecretType),
+		ClusterCA:          clusterCA,
+		APIServerURL:       restConfig.Host,
+		Permissions:        permissions,
+		HandlerTimeout:     handlerTimeout,
+	}
+	if err = reconciler.SetupWithManager(mgr); err != nil {
 		setupLog.Error(err, "unable to create controller", "controller", "ServiceAccount")
 		os.Exit(1)
 	}
 
+	if gcInterval > 0 {
+		if err := mgr.Add(&controller.SecretCollector{
+			Client:       mgr.GetClient(),
+			APIReader:    mgr.GetAPIReader(),
+			Recorder:     mgr.GetEventRecorderFor("service-account-token-operator"),
+			Log:          ctrl.Log.WithName("secret-collector"),
+			Interval:     gcInterval,
+			Policy:       orphanedSecrets,
+			RequireOptIn: requireOptInLabel,
+			DryRun:       dryRun,
+		}); err != nil {
+			setupLog.Error(err, "unable to add the orphaned secrets collector to manager")
+			os.Exit(1)
+		}
+	}
+
 	// +kubebuilder:scaffold:builder
 
 	if metricsCertWatcher != nil {
@@ -233,9 +350,25 @@ func main() {
 		setupLog.Error(err, "unable to set up ready check")
 		os.Exit(1)
 	}
+	if err := mgr.AddReadyzCheck("permissions", permissions.Check); err != nil {
+		setupLog.Error(err, "unable to set up permissions check")
+		os.Exit(1)
+	}
+	if err := mgr.AddReadyzCheck("cache", controller.CacheSyncCheck(mgr.GetCache())); err != nil {
+		setupLog.Error(err, "unable to set up cache check")
+		os.Exit(1)
+	}
+	if err := mgr.AddReadyzCheck("token-requests", controller.TokenRequestCheck); err != nil {
+		setupLog.Error(err, "unable to set up token requests check")
+		os.Exit(1)
+	}
+	if err := mgr.AddMetricsServerExtraHandler("/backlog", controller.BacklogHandler(mgr.GetClient(), reconciler.ModeConflictPolicy, reconciler.Clock)); err != nil {
+		setupLog.Error(err, "unable to set up backlog endpoint")
+		os.Exit(1)
+	}
 
 	setupLog.Info("starting manager")
-	if err := mgr.Start(ctrl.SetupSignalHandler()); err != nil {
+	if err := mgr.Start(ctx); err != nil {
 		setupLog.Error(err, "problem running manager")
 		os.Exit(1)
 	}
@@ -0,0 +1,86 @@
+package controller
+
+import (
+	"context"
+
+	corev1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/types"
+	"k8s.io/apimachinery/pkg/util/sets"
+	"k8s.io/client-go/util/csaupgrade"
+	"sigs.k8s.io/controller-runtime/pkg/client"
+)
+
+const fieldManager = "service-account-token-operator"
+
+// operatorAnnotations are always applied together, an applied configuration omitting one removes it.
+var operatorAnnotations = []string{
+	"or.io/last-renewal",
+	"or.io/token-expiration",
+	"or.io/rotation-handled",
+	StatusAnnotation,
+}
+
+// legacyFieldManager is named after the binary, the operator used Update before server-side apply.
+const legacyFieldManager = "manager"
+
+// upgradeManagedFields lets applies remove the fields written with Update. obj must hold its
+// managed fields, which the cache strips.
+func upgradeManagedFields(ctx context.Context, c client.Client, obj client.Object, dryRun bool) error {
+	patch, err := csaupgrade.UpgradeManagedFieldsPatch(obj, sets.New(legacyFieldManager), fieldManager)
+	if err != nil || patch == nil {
+		return err
+	}
+
+	var opts []client.PatchOption
+	if dryRun {
+		opts = append(opts, client.DryRunAll)
+	}
+
+	return c.Patch(ctx, obj, client.RawPatch(types.JSONPatchType, patch), opts...)
+}
+
+func applyOptions(dryRun bool) []client.PatchOption {
+	opts := []client.PatchOption{client.FieldOwner(fieldManager), client.ForceOwnership}
+	if dryRun {
+		opts = append(opts, client.DryRunAll)
+	}
+	return opts
+}
+
+func applySecret(ctx context.Context, c client.Client, secret *corev1.Secret, dryRun bool) error {
+	secret.TypeMeta = metav1.TypeMeta{APIVersion: "v1", Kind: "Secret"}
+	secret.ManagedFields = nil
+
+	return c.Patch(ctx, secret, client.Apply, applyOptions(dryRun)...)
+}
+
+// applyServiceAccountAnnotations updates sa with the response.
+func applyServiceAccountAnnotations(ctx context.Context, c client.Client, sa *corev1.ServiceAccount, dryRun bool) error {
+	if err := upgradeManagedFields(ctx, c, sa.DeepCopy(), dryRun); err != nil {
+		return err
+	}
+
+	applied := &corev1.ServiceAccount{
+		TypeMeta: metav1.TypeMeta{APIVersion: "v1", Kind: "ServiceAccount"},
+		ObjectMeta: metav1.ObjectMeta{
+			Name:        sa.Name,
+			Namespace:   sa.Namespace,
+			Annotations: map[string]string{},
+		},
+	}
+
+	for _, key := range operatorAnnotations {
+		if val, ok := sa.Annotations[key]; ok {
+			applied.Annotations[key] = val
+		}
+	}
+
+	if err := c.Patch(ctx, applied, client.Apply, applyOptions(dryRun)...); err != nil {
+		return err
+	}
+
+	applied.DeepCopyInto(sa)
+
+	return nil
+}
@@ -0,0 +1,27 @@
+package controller
+
+import (
+	corev1 "k8s.io/api/core/v1"
+	"k8s.io/apimachinery/pkg/labels"
+	"sigs.k8s.io/controller-runtime/pkg/cache"
+	"sigs.k8s.io/controller-runtime/pkg/client"
+)
+
+// OptInLabel is required on managed service accounts with --require-opt-in-label.
+const OptInLabel = "or.io/managed"
+
+// CacheOptions only caches the secrets managed by the operator, other secrets are read from the API server.
+func CacheOptions(requireOptIn bool) cache.Options {
+	opts := cache.Options{
+		DefaultTransform: cache.TransformStripManagedFields(),
+		ByObject: map[client.Object]cache.ByObject{
+			&corev1.Secret{}: {Label: labels.SelectorFromSet(managedSecretLabels())},
+		},
+	}
+
+	if requireOptIn {
+		opts.ByObject[&corev1.ServiceAccount{}] = cache.ByObject{Label: labels.SelectorFromSet(labels.Set{OptInLabel: "true"})}
+	}
+
+	return opts
+}
@@ -0,0 +1,193 @@
+package controller
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"os"
+	"runtime"
+	"strings"
+	"sync"
+	"testing"
+
+	corev1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/client-go/rest"
+	"sigs.k8s.io/controller-runtime/pkg/cache"
+	"sigs.k8s.io/controller-runtime/pkg/client"
+	"sigs.k8s.io/controller-runtime/pkg/envtest"
+)
+
+const (
+	benchServiceAccounts = 2000
+	benchNamespaces      = 20
+	// one service account in a hundred is managed (and opted in)
+	benchManagedEvery = 100
+)
+
+// benchObjects returns a service account with the usual labels and annotations of one applied by
+// a deployment tool, its image pull secret and, for managed ones, its token secret.
+func benchObjects(i int) []client.Object {
+	namespace := fmt.Sprintf("bench-%02d", i%benchNamespaces)
+	name := fmt.Sprintf("service-account-%d", i)
+
+	sa := &corev1.ServiceAccount{
+		ObjectMeta: metav1.ObjectMeta{
+			Name:      name,
+			Namespace: namespace,
+			Labels: map[string]string{
+				"app.kubernetes.io/name":       fmt.Sprintf("app-%d", i),
+				"app.kubernetes.io/managed-by": "Helm",
+			},
+			Annotations: map[string]string{
+				"meta.helm.sh/release-name":      fmt.Sprintf("release-%d", i),
+				"meta.helm.sh/release-namespace": namespace,
+			},
+		},
+		ImagePullSecrets: []corev1.LocalObjectReference{{Name: name + "-dockercfg"}},
+	}
+	pullSecret := &corev1.Secret{
+		ObjectMeta: metav1.ObjectMeta{Name: name + "-dockercfg", Namespace: namespace},
+		Type:       corev1.SecretTypeDockerConfigJson,
+		Data:       map[string][]byte{corev1.DockerConfigJsonKey: []byte(`{"auths":{"registry.example.com":{"auth":"` + strings.Repeat("a", 2048) + `"}}}`)},
+	}
+	objs := []client.Object{sa, pullSecret}
+
+	if i%benchManagedEvery == 0 {
+		sa.Labels[OptInLabel] = "true"
+		sa.Annotations["or.io/renew-after"] = "24h"
+		sa.Annotations["or.io/token-expiration"] = "2025-01-01T00:00:00Z"
+		sa.Annotations["or.io/last-renewal"] = "2024-12-31T00:00:00Z"
+
+		objs = append(objs, &corev1.Secret{
+			ObjectMeta: metav1.ObjectMeta{Name: TokenSecretName(name), Namespace: namespace, Labels: managedSecretLabels()},
+			Data:       map[string][]byte{"token": []byte(strings.Repeat("t", 1024)), "namespace": []byte(namespace)},
+		})
+	}
+
+	return objs
+}
+
+// startBenchEnv starts an API server holding the service accounts and secrets of a cluster.
+func startBenchEnv(b *testing.B) *rest.Config {
+	binaryDir := getFirstFoundEnvTestBinaryDir()
+	if os.Getenv("KUBEBUILDER_ASSETS") == "" && binaryDir == "" {
+		b.Skip("no envtest binaries found, run `make setup-envtest` or set KUBEBUILDER_ASSETS")
+	}
+
+	env := &envtest.Environment{BinaryAssetsDirectory: binaryDir}
+	cfg, err := env.Start()
+	if err != nil {
+		b.Fatal(err)
+	}
+	b.Cleanup(func() {
+		if err := env.Stop(); err != nil {
+			b.Error(err)
+		}
+	})
+
+	c, err := client.New(cfg, client.Options{})
+	if err != nil {
+		b.Fatal(err)
+	}
+
+	ctx := context.Background()
+	for i := range benchNamespaces {
+		ns := &corev1.Namespace{ObjectMeta: metav1.ObjectMeta{Name: fmt.Sprintf("bench-%02d", i)}}
+		if err := c.Create(ctx, ns); err != nil {
+			b.Fatal(err)
+		}
+	}
+
+	var (
+		wg   sync.WaitGroup
+		mu   sync.Mutex
+		errs []error
+	)
+	sem := make(chan struct{}, 16)
+	for i := range benchServiceAccounts {
+		wg.Add(1)
+		sem <- struct{}{}
+		go func() {
+			defer func() { <-sem; wg.Done() }()
+			for _, obj := range benchObjects(i) {
+				if err := c.Create(ctx, obj); err != nil {
+					mu.Lock()
+					errs = append(errs, err)
+					mu.Unlock()
+				}
+			}
+		}()
+	}
+	wg.Wait()
+	if err := errors.Join(errs...); err != nil {
+		b.Fatal(err)
+	}
+
+	return cfg
+}
+
+func heapAlloc() int64 {
+	runtime.GC()
+
+	var stats runtime.MemStats
+	runtime.ReadMemStats(&stats)
+
+	return int64(stats.HeapAlloc)
+}
+
+// benchmarkCache starts a cache with the options and informers for the objects, and reports the
+// heap it retains once synced per service account in the cluster.
+func benchmarkCache(b *testing.B, cfg *rest.Config, opts cache.Options, objs ...client.Object) {
+	var retained int64
+	for range b.N {
+		ctx, cancel := context.WithCancel(context.Background())
+
+		before := heapAlloc()
+		c, err := cache.New(cfg, opts)
+		if err != nil {
+			b.Fatal(err)
+		}
+		for _, obj := range objs {
+			if _, err := c.GetInformer(ctx, obj); err != nil {
+				b.Fatal(err)
+			}
+		}
+		go func() {
+			if err := c.Start(ctx); err != nil {
+				b.Error(err)
+			}
+		}()
+		if !c.WaitForCacheSync(ctx) {
+			b.Fatal("cache did not sync")
+		}
+		retained = heapAlloc() - before
+
+		runtime.KeepAlive(c)
+		cancel()
+	}
+
+	b.ReportMetric(float64(retained)/benchServiceAccounts, "bytes/sa")
+}
+
+// BenchmarkCache compares the memory used by the cache of the manager before (full service
+// accounts and secrets) and after (CacheOptions, with and without the opt-in label) on a
+// cluster where most service accounts and secrets are not managed.
+func BenchmarkCache(b *testing.B) {
+	cfg := startBenchEnv(b)
+
+	serviceAccountMetadata := &metav1.PartialObjectMetadata{}
+	serviceAccountMetadata.SetGroupVersionKind(corev1.SchemeGroupVersion.WithKind("ServiceAccount"))
+
+	b.Run("full", func(b *testing.B) {
+		benchmarkCache(b, cfg, cache.Options{}, &corev1.ServiceAccount{}, &corev1.Secret{})
+	})
+
+	b.Run("metadata", func(b *testing.B) {
+		benchmarkCache(b, cfg, CacheOptions(false), serviceAccountMetadata, &corev1.Secret{})
+	})
+
+	b.Run("metadata-opt-in", func(b *testing.B) {
+		benchmarkCache(b, cfg, CacheOptions(true), serviceAccountMetadata, &corev1.Secret{})
+	})
+}
@@ -0,0 +1,12 @@
+package controller
+
+import (
+	"k8s.io/utils/clock"
+)
+
+func clockOrReal(c clock.PassiveClock) clock.PassiveClock {
+	if c == nil {
+		return clock.RealClock{}
+	}
+	return c
+}
@@ -0,0 +1,63 @@
+package controller
+
+import (
+	"fmt"
+
+	"github.com/go-logr/logr"
+	corev1 "k8s.io/api/core/v1"
+	"k8s.io/client-go/tools/record"
+	"sigs.k8s.io/controller-runtime/pkg/client"
+)
+
+type action struct {
+	name   string
+	reason string
+	verb   string
+	done   string
+}
+
+var (
+	actionCreateSecret      = action{name: "create-secret", reason: "SecretCreated", verb: "create", done: "created"}
+	actionIssueToken        = action{name: "issue-token", reason: "TokenIssued", verb: "issue", done: "issued"}
+	actionAdoptSecret       = action{name: "adopt-secret", reason: "SecretAdopted", verb: "adopt", done: "adopted"}
+	actionDeleteSecret      = action{name: "delete-secret", reason: "SecretDeleted", verb: "delete", done: "deleted"}
+	actionWriteSecret       = action{name: "write-secret", reason: "SecretUpdated", verb: "write", done: "wrote"}
+	actionUpdateAnnotations = action{name: "update-annotations", reason: "AnnotationsUpdated", verb: "update", done: "updated"}
+)
+
+// recordAction logs, counts and emits an event for an action, in dry-run mode one that was not persisted.
+func recordAction(recorder record.EventRecorder, log logr.Logger, sa *corev1.ServiceAccount, a action, dryRun bool, object string) {
+	countAction(a.name, dryRun)
+
+	reason := a.reason
+	message := fmt.Sprintf("%s %s", a.done, object)
+	if dryRun {
+		reason = "DryRun"
+		message = fmt.Sprintf("would %s %s", a.verb, object)
+	}
+
+	log.Info(message, "action", a.name, "dryRun", dryRun)
+
+	if recorder != nil {
+		recorder.Event(sa, corev1.EventTypeNormal, reason, message)
+	}
+}
+
+func recordNormal(recorder record.EventRecorder, sa *corev1.ServiceAccount, reason string, message string) {
+	if recorder != nil {
+		recorder.Event(sa, corev1.EventTypeNormal, reason, message)
+	}
+}
+
+func recordWarning(recorder record.EventRecorder, sa *corev1.ServiceAccount, reason string, message string) {
+	if recorder != nil {
+		recorder.Event(sa, corev1.EventTypeWarning, reason, message)
+	}
+}
+
+func deleteOptions(dryRun bool) []client.DeleteOption {
+	if dryRun {
+		return []client.DeleteOption{client.DryRunAll}
+	}
+	return nil
+}
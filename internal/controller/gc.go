@@ -0,0 +1,162 @@
+package controller
+
+import (
+	"context"
+	"fmt"
+	"time"
+
+	"github.com/go-logr/logr"
+	corev1 "k8s.io/api/core/v1"
+	apierrors "k8s.io/apimachinery/pkg/api/errors"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/types"
+	"k8s.io/client-go/tools/record"
+	"sigs.k8s.io/controller-runtime/pkg/client"
+)
+
+// Policies for orphaned secrets.
+const (
+	OrphanReport = "report"
+	OrphanDelete = "delete"
+)
+
+func ValidateOrphanPolicy(policy string) error {
+	switch policy {
+	case OrphanReport, OrphanDelete:
+		return nil
+	}
+
+	return fmt.Errorf("unknown orphaned secrets policy %q, must be one of: %s, %s", policy, OrphanReport, OrphanDelete)
+}
+
+// SecretCollector is needed since owner references do not block the deletion of service accounts
+// and can be stripped.
+type SecretCollector struct {
+	client.Client
+	// APIReader does not mistake a service account missing from the cache for a deleted one.
+	APIReader    client.Reader
+	Recorder     record.EventRecorder
+	Log          logr.Logger
+	Interval     time.Duration
+	Policy       string
+	RequireOptIn bool
+	DryRun       bool
+}
+
+func (g *SecretCollector) NeedLeaderElection() bool {
+	return true
+}
+
+func (g *SecretCollector) Start(ctx context.Context) error {
+	ticker := time.NewTicker(g.Interval)
+	defer ticker.Stop()
+
+	for {
+		if err := g.collect(ctx); err != nil {
+			g.Log.Error(err, "failed to collect orphaned secrets")
+		}
+
+		select {
+		case <-ctx.Done():
+			return nil
+		case <-ticker.C:
+		}
+	}
+}
+
+func (g *SecretCollector) collect(ctx context.Context) error {
+	secrets := &corev1.SecretList{}
+	if err := g.List(ctx, secrets, client.MatchingLabels{ManagedByLabel: ManagedByValue}); err != nil {
+		return err
+	}
+
+	orphaned, failed := 0, 0
+	for i := range secrets.Items {
+		secret := &secrets.Items[i]
+
+		reason, err := g.orphanReason(ctx, secret)
+		if err != nil {
+			failed++
+			gcErrorsTotal.Inc()
+			g.Log.Error(err, "failed to check whether secret is orphaned", "name", secret.Name, "namespace", secret.Namespace)
+			continue
+		}
+		if reason == "" {
+			continue
+		}
+		orphaned++
+
+		if g.Policy != OrphanDelete {
+			g.Log.Info("found orphaned secret", "name", secret.Name, "namespace", secret.Namespace, "reason", reason)
+			if g.Recorder != nil {
+				g.Recorder.Event(secret, corev1.EventTypeWarning, "OrphanedSecret", fmt.Sprintf("secret is orphaned: %s", reason))
+			}
+			continue
+		}
+
+		deleteOpts := append(deleteOptions(g.DryRun), client.Preconditions{UID: &secret.UID})
+		if err := g.Delete(ctx, secret, deleteOpts...); client.IgnoreNotFound(err) != nil {
+			failed++
+			gcErrorsTotal.Inc()
+			g.Log.Error(err, "failed to delete orphaned secret", "name", secret.Name, "namespace", secret.Namespace, "reason", reason)
+			continue
+		}
+
+		countAction("delete-orphaned-secret", g.DryRun)
+		g.Log.Info("deleted orphaned secret", "name", secret.Name, "namespace", secret.Namespace, "reason", reason, "dryRun", g.DryRun)
+		if g.Recorder != nil && g.DryRun {
+			g.Recorder.Event(secret, corev1.EventTypeNormal, "DryRun", fmt.Sprintf("would delete orphaned secret: %s", reason))
+		}
+	}
+
+	orphanedSecrets.Set(float64(orphaned))
+
+	if failed > 0 {
+		return fmt.Errorf("%d of %d secrets could not be collected", failed, len(secrets.Items))
+	}
+
+	return nil
+}
+
+// orphanReason is empty when the secret is still in use.
+func (g *SecretCollector) orphanReason(ctx context.Context, secret *corev1.Secret) (string, error) {
+	saName := secret.Labels[serviceAccountLabel]
+	if saName == "" {
+		saName = secret.Annotations["kubernetes.io/service-account.name"]
+	}
+	if saName == "" {
+		return "", nil
+	}
+
+	sa := &metav1.PartialObjectMetadata{}
+	sa.SetGroupVersionKind(corev1.SchemeGroupVersion.WithKind("ServiceAccount"))
+	if err := g.APIReader.Get(ctx, types.NamespacedName{Namespace: secret.Namespace, Name: saName}, sa); err != nil {
+		if apierrors.IsNotFound(err) {
+			return fmt.Sprintf("service account %s does not exist", saName), nil
+		}
+		return "", err
+	}
+
+	// nothing is cleaned up while management is suspended
+	if isSuspended(sa.Annotations) {
+		return "", nil
+	}
+
+	owner := metav1.GetControllerOf(secret)
+	if owner != nil && owner.UID != sa.UID {
+		return fmt.Sprintf("service account %s was recreated", saName), nil
+	}
+
+	mode := ManagementMode(sa.Annotations)
+	switch {
+	case mode == "" || (g.RequireOptIn && sa.Labels[OptInLabel] != "true"):
+		return fmt.Sprintf("service account %s is not managed anymore", saName), nil
+	case mode == ModeNamedTokens && secret.Labels[tokenNameLabel] == "":
+		return fmt.Sprintf("service account %s only has named tokens", saName), nil
+	// the reconciler owns it again
+	case owner == nil && secret.Annotations["kubernetes.io/service-account.name"] != saName:
+		return "its owner reference was removed", nil
+	}
+
+	return "", nil
+}
@@ -0,0 +1,185 @@
+package controller
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"sync"
+	"time"
+
+	corev1 "k8s.io/api/core/v1"
+	apierrors "k8s.io/apimachinery/pkg/api/errors"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/utils/clock"
+	"sigs.k8s.io/controller-runtime/pkg/cache"
+	"sigs.k8s.io/controller-runtime/pkg/client"
+	"sigs.k8s.io/controller-runtime/pkg/healthz"
+)
+
+// tokenRequestFailureThreshold counts consecutive transient failures across all service accounts.
+const tokenRequestFailureThreshold = 5
+
+type tokenRequestTracker struct {
+	mu                  sync.Mutex
+	consecutiveFailures int
+	lastErr             error
+}
+
+var tokenRequests = &tokenRequestTracker{}
+
+// transientTokenRequestError excludes the errors caused by a service account (forbidden, not found...).
+func transientTokenRequestError(err error) bool {
+	if apierrors.IsInternalError(err) || apierrors.IsServerTimeout(err) || apierrors.IsTimeout(err) ||
+		apierrors.IsTooManyRequests(err) || apierrors.IsServiceUnavailable(err) || apierrors.IsUnexpectedServerError(err) {
+		return true
+	}
+
+	// not an answer of the API server, e.g. a connection error or a deadline
+	var status apierrors.APIStatus
+	return !errors.As(err, &status)
+}
+
+func (t *tokenRequestTracker) record(err error) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	if err != nil && !transientTokenRequestError(err) {
+		return
+	}
+
+	if err == nil {
+		t.consecutiveFailures = 0
+		t.lastErr = nil
+		return
+	}
+
+	t.consecutiveFailures++
+	t.lastErr = err
+}
+
+func TokenRequestCheck(_ *http.Request) error {
+	tokenRequests.mu.Lock()
+	defer tokenRequests.mu.Unlock()
+
+	if tokenRequests.consecutiveFailures >= tokenRequestFailureThreshold {
+		return fmt.Errorf("the last %d token requests failed: %w", tokenRequests.consecutiveFailures, tokenRequests.lastErr)
+	}
+
+	return nil
+}
+
+func CacheSyncCheck(c cache.Cache) healthz.Checker {
+	return func(req *http.Request) error {
+		ctx, cancel := context.WithTimeout(req.Context(), time.Second)
+		defer cancel()
+
+		if !c.WaitForCacheSync(ctx) {
+			return errors.New("informer caches are not synced")
+		}
+
+		return nil
+	}
+}
+
+type Backlog struct {
+	Managed int `json:"managed"`
+	// Pending tokens were never issued.
+	Pending int `json:"pending"`
+	Due     int `json:"due"`
+	Overdue int `json:"overdue"`
+	Expired int `json:"expired"`
+}
+
+func (b *Backlog) count(expiration time.Time, lifetime time.Duration, now time.Time) {
+	b.Managed++
+
+	remaining := expiration.Sub(now)
+	switch {
+	case remaining <= 0:
+		b.Expired++
+	// tokens are renewed requeueMargin before they expire, give the reconciliation some slack
+	case remaining < requeueMargin(lifetime)/2:
+		b.Overdue++
+	case remaining < renewalThreshold(lifetime):
+		b.Due++
+	}
+}
+
+func computeBacklog(ctx context.Context, c client.Reader, conflictPolicy string, now time.Time) (Backlog, error) {
+	var backlog Backlog
+
+	// only the metadata of service accounts is cached
+	serviceAccounts := &metav1.PartialObjectMetadataList{}
+	serviceAccounts.SetGroupVersionKind(corev1.SchemeGroupVersion.WithKind("ServiceAccountList"))
+	if err := c.List(ctx, serviceAccounts); err != nil {
+		return backlog, err
+	}
+
+	suspended := map[string]bool{}
+	for _, sa := range serviceAccounts.Items {
+		if isSuspended(sa.Annotations) {
+			suspended[sa.Namespace+"/"+sa.Name] = true
+			continue
+		}
+
+		if modeUnderPolicy(sa.Annotations, conflictPolicy) != ModeRenewal {
+			continue
+		}
+
+		lifetime, err := getRenewalPeriod(sa.Annotations)
+		if err != nil {
+			continue
+		}
+
+		expiration, ok := tokenExpiration(sa.Annotations)
+		if !ok {
+			backlog.Managed++
+			backlog.Pending++
+			continue
+		}
+
+		backlog.count(expiration, lifetime, now)
+	}
+
+	secrets := &corev1.SecretList{}
+	if err := c.List(ctx, secrets, client.MatchingLabels{ManagedByLabel: ManagedByValue}, client.HasLabels{tokenNameLabel}); err != nil {
+		return backlog, err
+	}
+
+	for _, secret := range secrets.Items {
+		if suspended[secret.Namespace+"/"+secret.Labels[serviceAccountLabel]] {
+			continue
+		}
+
+		expiration, ok := tokenExpiration(secret.Annotations)
+		lastRenewal, err := time.Parse(time.RFC3339, secret.Annotations["or.io/last-renewal"])
+		if !ok || err != nil {
+			continue
+		}
+
+		backlog.count(expiration, expiration.Sub(lastRenewal), now)
+	}
+
+	return backlog, nil
+}
+
+// BacklogHandler answers 503 when tokens are expired or overdue. conflictPolicy is the mode
+// conflict policy of the reconciler.
+func BacklogHandler(c client.Reader, conflictPolicy string, clk clock.PassiveClock) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		backlog, err := computeBacklog(req.Context(), c, conflictPolicy, clockOrReal(clk).Now())
+		if err != nil {
+			http.Error(w, fmt.Sprintf("failed to compute backlog: %v", err), http.StatusInternalServerError)
+			return
+		}
+
+		w.Header().Set("Content-Type", "application/json")
+		if backlog.Expired+backlog.Overdue > 0 {
+			w.WriteHeader(http.StatusServiceUnavailable)
+		}
+
+		_ = json.NewEncoder(w).Encode(backlog)
+	})
+}
@@ -0,0 +1,250 @@
+package controller
+
+import (
+	"fmt"
+	"os"
+	"time"
+
+	corev1 "k8s.io/api/core/v1"
+	"k8s.io/client-go/rest"
+)
+
+// RotateAnnotation triggers a rotation whenever its value changes.
+const RotateAnnotation = "or.io/rotate"
+
+// StatusAnnotation holds why the service account is not managed as requested.
+const StatusAnnotation = "or.io/status"
+
+// DefaultRenewalSecretType is not kubernetes.io/service-account-token, the token controller would
+// write a non-expiring token to it.
+const DefaultRenewalSecretType = corev1.SecretTypeOpaque
+
+const (
+	ModeLongLived = "long-lived"
+	ModeRenewal   = "renewal"
+	// ModeNamedTokens is the mode of a service account with only named tokens.
+	ModeNamedTokens = "named-tokens"
+)
+
+type TokenStatus struct {
+	Namespace       string `json:"namespace"`
+	Name            string `json:"name"`
+	Mode            string `json:"mode"`
+	ModeConflict    bool   `json:"modeConflict,omitempty"`
+	Secret          string `json:"secret"`
+	RenewAfter      string `json:"renewAfter,omitempty"`
+	Expiration      string `json:"expiration,omitempty"`
+	LastRenewal     string `json:"lastRenewal,omitempty"`
+	RotationPending bool   `json:"rotationPending,omitempty"`
+	Status          string `json:"status,omitempty"`
+	Suspended       bool   `json:"suspended,omitempty"`
+	// NamedTokens lists the secrets of the named tokens, <secret> (<format>, <lifetime>).
+	NamedTokens []string `json:"namedTokens,omitempty"`
+}
+
+// ManagementMode resolves conflicting modes with the default policy of the operator.
+func ManagementMode(annotations map[string]string) string {
+	for _, additional := range []bool{false, true} {
+		for _, m := range modes {
+			if m.additional == additional && m.enabled(annotations) {
+				return m.name
+			}
+		}
+	}
+
+	return ""
+}
+
+func ClusterCA(restConfig *rest.Config) ([]byte, error) {
+	if len(restConfig.CAData) > 0 {
+		return restConfig.CAData, nil
+	}
+
+	if restConfig.CAFile != "" {
+		return os.ReadFile(restConfig.CAFile)
+	}
+
+	return nil, nil
+}
+
+func TokenSecretName(saName string) string {
+	return fmt.Sprintf("%s-token", saName)
+}
+
+func NamedTokenSecretNames(sa *corev1.ServiceAccount) []string {
+	specs, _ := getTokenSpecs(sa.Annotations)
+
+	names := make([]string, 0, len(specs))
+	for _, spec := range specs {
+		names = append(names, namedTokenSecretName(sa.Name, spec.Name))
+	}
+
+	return names
+}
+
+func TokenExpiration(annotations map[string]string) (time.Time, bool) {
+	return tokenExpiration(annotations)
+}
+
+func Inspect(sa *corev1.ServiceAccount) TokenStatus {
+	status := TokenStatus{
+		Namespace:       sa.Namespace,
+		Name:            sa.Name,
+		Mode:            ManagementMode(sa.Annotations),
+		ModeConflict:    hasModeConflict(sa.Annotations),
+		Secret:          TokenSecretName(sa.Name),
+		RenewAfter:      sa.Annotations["or.io/renew-after"],
+		Expiration:      sa.Annotations["or.io/token-expiration"],
+		LastRenewal:     sa.Annotations["or.io/last-renewal"],
+		RotationPending: rotationRequested(sa.Annotations),
+		Status:          sa.Annotations[StatusAnnotation],
+		Suspended:       isSuspended(sa.Annotations),
+	}
+
+	if ManagementMode(sa.Annotations) == ModeNamedTokens {
+		status.Secret = ""
+	}
+
+	// invalid specs are reported by the operator through its logs
+	specs, _ := getTokenSpecs(sa.Annotations)
+	for _, spec := range specs {
+		status.NamedTokens = append(status.NamedTokens, fmt.Sprintf("%s (%s, %s)", namedTokenSecretName(sa.Name, spec.Name), spec.Format, spec.Lifetime.Duration))
+	}
+
+	return status
+}
+
+// Plan returns the actions of the next reconciliation, secret is nil when there is no token secret.
+// namedSecrets holds the secrets of the named tokens by name, missing ones do not exist.
+func Plan(sa *corev1.ServiceAccount, secret *corev1.Secret, namedSecrets map[string]*corev1.Secret) ([]string, error) {
+	if isSuspended(sa.Annotations) {
+		return []string{"nothing, management is suspended"}, nil
+	}
+
+	// named tokens are handled before the mode of the service account, a foreign secret stops both
+	actions, blocked, err := planNamedTokens(sa, namedSecrets)
+	if err != nil || blocked {
+		return actions, err
+	}
+
+	modeActions, err := planMode(sa, secret)
+	if err != nil {
+		return nil, err
+	}
+
+	return append(actions, modeActions...), nil
+}
+
+func planNamedTokens(sa *corev1.ServiceAccount, namedSecrets map[string]*corev1.Secret) ([]string, bool, error) {
+	if !hasNamedTokensAnnotation(sa.Annotations) {
+		return nil, false, nil
+	}
+
+	specs, err := getTokenSpecs(sa.Annotations)
+	if err != nil {
+		return nil, false, err
+	}
+
+	var actions []string
+	h := &NamedTokensHandler{}
+	for _, spec := range specs {
+		secretName := namedTokenSecretName(sa.Name, spec.Name)
+		secret := namedSecrets[secretName]
+
+		if secret != nil {
+			switch classifySecret(secret, sa) {
+			case secretForeign:
+				return []string{fmt.Sprintf("nothing, secret %s is not managed by the operator", secretName)}, true, nil
+			case secretAdoptable:
+				actions = append(actions, fmt.Sprintf("adopt legacy secret %s (only when adoption is enabled)", secretName))
+			case secretDisowned:
+				actions = append(actions, fmt.Sprintf("restore the owner reference of secret %s", secretName))
+			}
+		}
+
+		if h.needsRenewal(time.Now(), sa, spec, secret) {
+			actions = append(actions,
+				fmt.Sprintf("issue token %s valid for %s", spec.Name, spec.Lifetime.Duration),
+				fmt.Sprintf("write secret %s", secretName),
+			)
+		}
+	}
+
+	return actions, false, nil
+}
+
+func planMode(sa *corev1.ServiceAccount, secret *corev1.Secret) ([]string, error) {
+	secretName := TokenSecretName(sa.Name)
+
+	var actions []string
+	if secret != nil && ManagementMode(sa.Annotations) != "" && ManagementMode(sa.Annotations) != ModeNamedTokens {
+		switch classifySecret(secret, sa) {
+		case secretForeign:
+			return []string{fmt.Sprintf("nothing, secret %s is not managed by the operator", secretName)}, nil
+		case secretAdoptable:
+			actions = append(actions, fmt.Sprintf("adopt legacy secret %s (only when adoption is enabled)", secretName))
+		case secretDisowned:
+			actions = append(actions, fmt.Sprintf("restore the owner reference of secret %s", secretName))
+		case secretStale:
+			if ManagementMode(sa.Annotations) == ModeLongLived && !rotationRequested(sa.Annotations) {
+				return append(actions,
+					fmt.Sprintf("delete secret %s of a previous service account with the same name", secretName),
+					fmt.Sprintf("create secret %s", secretName),
+				), nil
+			}
+			actions = append(actions, fmt.Sprintf("reissue the token of secret %s, written for a previous service account with the same name", secretName))
+		}
+	}
+
+	switch ManagementMode(sa.Annotations) {
+	case ModeLongLived:
+		if secret != nil && !rotationRequested(sa.Annotations) && !isLegacySecret(secret, sa) {
+			return append(actions,
+				fmt.Sprintf("delete renewal secret %s", secretName),
+				fmt.Sprintf("create secret %s", secretName),
+			), nil
+		}
+
+		if rotationRequested(sa.Annotations) {
+			return append(actions,
+				fmt.Sprintf("delete secret %s", secretName),
+				fmt.Sprintf("create secret %s", secretName),
+				"update rotation annotations",
+			), nil
+		}
+
+		if secret == nil {
+			return []string{fmt.Sprintf("create secret %s", secretName)}, nil
+		}
+	case ModeRenewal:
+		renewalPeriod, err := getRenewalPeriod(sa.Annotations)
+		if err != nil {
+			return nil, err
+		}
+
+		h := &RenewalHandler{RenewalAfter: renewalPeriod}
+		needsRenewal := h.needsRenewal(time.Now(), sa)
+
+		if secret != nil && classifySecret(secret, sa) == secretStale {
+			needsRenewal = true
+		}
+
+		if secret != nil && isLegacySecret(secret, sa) {
+			actions = append(actions, fmt.Sprintf("replace legacy long-lived secret %s", secretName))
+			needsRenewal = true
+		} else if secret != nil && secret.Type != DefaultRenewalSecretType {
+			actions = append(actions, fmt.Sprintf("replace secret %s of type %s (unless the operator is configured to use that type)", secretName, secret.Type))
+			needsRenewal = true
+		}
+
+		if needsRenewal {
+			return append(actions,
+				fmt.Sprintf("issue token valid for %s", renewalPeriod),
+				fmt.Sprintf("write secret %s", secretName),
+				"update renewal annotations",
+			), nil
+		}
+	}
+
+	return actions, nil
+}
@@ -0,0 +1,73 @@
+package controller
+
+import (
+	"slices"
+	"testing"
+	"time"
+
+	corev1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+)
+
+func TestPlanNamedTokens(t *testing.T) {
+	sa := &corev1.ServiceAccount{ObjectMeta: metav1.ObjectMeta{
+		Name:        "app",
+		Namespace:   "team",
+		UID:         "app-uid",
+		Annotations: map[string]string{NamedTokensAnnotation: "- name: ci\n  lifetime: 1h\n"},
+	}}
+	specs, err := getTokenSpecs(sa.Annotations)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	secret := func(expiration time.Time) *corev1.Secret {
+		return &corev1.Secret{ObjectMeta: metav1.ObjectMeta{
+			Name:            "app-ci",
+			Namespace:       "team",
+			Labels:          managedSecretLabels(),
+			OwnerReferences: []metav1.OwnerReference{tokenSecretOwnerRef(sa)},
+			Annotations: map[string]string{
+				tokenSpecAnnotation:      specs[0].hash(),
+				"or.io/token-expiration": expiration.Format(time.RFC3339),
+			},
+		}}
+	}
+
+	tests := []struct {
+		name    string
+		secrets map[string]*corev1.Secret
+		want    []string
+	}{
+		{
+			name: "missing secret",
+			want: []string{"issue token ci valid for 1h0m0s", "write secret app-ci"},
+		},
+		{
+			name:    "valid token",
+			secrets: map[string]*corev1.Secret{"app-ci": secret(time.Now().Add(50 * time.Minute))},
+		},
+		{
+			name:    "token due for renewal",
+			secrets: map[string]*corev1.Secret{"app-ci": secret(time.Now().Add(5 * time.Minute))},
+			want:    []string{"issue token ci valid for 1h0m0s", "write secret app-ci"},
+		},
+		{
+			name:    "foreign secret",
+			secrets: map[string]*corev1.Secret{"app-ci": {ObjectMeta: metav1.ObjectMeta{Name: "app-ci", Namespace: "team"}}},
+			want:    []string{"nothing, secret app-ci is not managed by the operator"},
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, err := Plan(sa, nil, tt.secrets)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if !slices.Equal(got, tt.want) {
+				t.Errorf("Plan() = %q, want %q", got, tt.want)
+			}
+		})
+	}
+}
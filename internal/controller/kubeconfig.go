@@ -0,0 +1,27 @@
+package controller
+
+import (
+	"fmt"
+
+	"k8s.io/client-go/tools/clientcmd"
+	clientcmdapi "k8s.io/client-go/tools/clientcmd/api"
+)
+
+func RenderKubeconfig(server string, caData []byte, namespace string, saName string, token string) ([]byte, error) {
+	contextName := fmt.Sprintf("%s/%s", namespace, saName)
+
+	kubeconfig := clientcmdapi.Config{
+		Clusters: map[string]*clientcmdapi.Cluster{
+			"cluster": {Server: server, CertificateAuthorityData: caData},
+		},
+		AuthInfos: map[string]*clientcmdapi.AuthInfo{
+			saName: {Token: token},
+		},
+		Contexts: map[string]*clientcmdapi.Context{
+			contextName: {Cluster: "cluster", AuthInfo: saName, Namespace: namespace},
+		},
+		CurrentContext: contextName,
+	}
+
+	return clientcmd.Write(kubeconfig)
+}
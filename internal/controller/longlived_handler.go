@@ -4,54 +4,150 @@ import (
 	"context"
 	"fmt"
 
-	"github.com/go-logr/logr"
 	corev1 "k8s.io/api/core/v1"
-	apierrors "k8s.io/apimachinery/pkg/api/errors"
 	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/client-go/tools/record"
 	ctrl "sigs.k8s.io/controller-runtime"
 	"sigs.k8s.io/controller-runtime/pkg/client"
 )
 
 type LongLivedHandler struct {
-	Sa  *corev1.ServiceAccount
-	Ctx context.Context
 	client.Client
-	Log logr.Logger
+	// APIReader defaults to the client.
+	APIReader   client.Reader
+	Recorder    record.EventRecorder
+	DryRun      bool
+	AdoptLegacy bool
 }
 
-func (h *LongLivedHandler) attemptToCreateSecret() error {
-	ownerRef := *metav1.NewControllerRef(h.Sa, corev1.SchemeGroupVersion.WithKind("ServiceAccount"))
-	*ownerRef.BlockOwnerDeletion = false
+var longLivedMode = &managementMode{
+	name:       ModeLongLived,
+	order:      10,
+	annotation: "or.io/create-secret",
+	permissions: []permission{
+		{resource: "secrets", verb: "create"},
+		{resource: "secrets", verb: "patch"},
+		{resource: "secrets", verb: "delete"},
+	},
+	newHandler: func(r *ServiceAccountReconciler, sa *corev1.ServiceAccount, _ bool) (Handler, error) {
+		return &LongLivedHandler{Client: r.Client, APIReader: r.APIReader, Recorder: r.Recorder, DryRun: r.DryRun, AdoptLegacy: r.AdoptLegacySecrets}, nil
+	},
+}
+
+func init() {
+	registerMode(longLivedMode)
+}
 
+func (h *LongLivedHandler) attemptToCreateSecret(ctx context.Context, sa *corev1.ServiceAccount) error {
 	secret := &corev1.Secret{
 		ObjectMeta: metav1.ObjectMeta{
-			Name:      fmt.Sprintf("%s-token", h.Sa.Name),
-			Namespace: h.Sa.Namespace,
+			Name:      TokenSecretName(sa.Name),
+			Namespace: sa.Namespace,
+			Labels:    managedSecretLabels(),
 			Annotations: map[string]string{
-				"kubernetes.io/service-account.name": h.Sa.Name,
+				"kubernetes.io/service-account.name": sa.Name,
+				secretModeAnnotation:                 ModeLongLived,
 			},
 			OwnerReferences: []metav1.OwnerReference{
-				ownerRef,
+				tokenSecretOwnerRef(sa),
 			},
 		},
 		Type: corev1.SecretTypeServiceAccountToken,
 	}
 
-	return h.Create(h.Ctx, secret)
+	return applySecret(ctx, h.Client, secret, h.DryRun)
+}
+
+// deleteSecret invalidates the long-lived token, the UID precondition only deletes the inspected secret.
+func (h *LongLivedHandler) deleteSecret(ctx context.Context, sa *corev1.ServiceAccount, secret *corev1.Secret) error {
+	log := ctrl.LoggerFrom(ctx)
+
+	deleteOpts := append(deleteOptions(h.DryRun), client.Preconditions{UID: &secret.UID})
+	if err := h.Delete(ctx, secret, deleteOpts...); client.IgnoreNotFound(err) != nil {
+		return err
+	}
+
+	recordAction(h.Recorder, log, sa, actionDeleteSecret, h.DryRun, fmt.Sprintf("secret %s", secret.Name))
+
+	return nil
+}
+
+func (h *LongLivedHandler) rotate(ctx context.Context, sa *corev1.ServiceAccount, existing *corev1.Secret) error {
+	log := ctrl.LoggerFrom(ctx)
+	log.Info("rotation requested, recreating secret for service account")
+
+	if existing != nil {
+		if err := h.deleteSecret(ctx, sa, existing); err != nil {
+			return err
+		}
+	}
+
+	if err := h.attemptToCreateSecret(ctx, sa); err != nil {
+		return err
+	}
+	recordAction(h.Recorder, log, sa, actionCreateSecret, h.DryRun, fmt.Sprintf("secret %s", TokenSecretName(sa.Name)))
+
+	markRotationHandled(sa.Annotations)
+	if err := applyServiceAccountAnnotations(ctx, h.Client, sa, h.DryRun); err != nil {
+		return err
+	}
+	recordAction(h.Recorder, log, sa, actionUpdateAnnotations, h.DryRun, "rotation annotations")
+
+	return nil
 }
 
-func (h *LongLivedHandler) Handle() (ctrl.Result, error) {
-	h.Log.Info("attempting to create secret for service account", "name", h.Sa.Name, "namespace", h.Sa.Namespace)
+func (h *LongLivedHandler) Handle(ctx context.Context, sa *corev1.ServiceAccount) (ctrl.Result, error) {
+	log := ctrl.LoggerFrom(ctx)
 
-	err := h.attemptToCreateSecret()
+	existing, err := getTokenSecret(ctx, readerOrClient(h.APIReader, h.Client), sa)
 	if err != nil {
-		if apierrors.IsAlreadyExists(err) {
-			h.Log.Info("secret already exists for the service account, skipping creation", "name", h.Sa.Name, "namespace", h.Sa.Namespace)
-			return ctrl.Result{}, nil
+		return ctrl.Result{}, fmt.Errorf("failed to get secret of service account: %w", err)
+	}
+
+	if existing != nil {
+		claim := &secretClaim{Client: h.Client, Recorder: h.Recorder, AdoptLegacy: h.AdoptLegacy, DryRun: h.DryRun}
+		if err := claim.claim(ctx, sa, existing); err != nil {
+			return ctrl.Result{}, err
 		}
 
-		h.Log.Error(err, "failed to create secret for service account", "name", h.Sa.Name, "namespace", h.Sa.Namespace)
+		if classifySecret(existing, sa) == secretStale {
+			log.Info("secret was created for a previous service account with the same name, recreating it")
+			recordWarning(h.Recorder, sa, "StaleSecret", fmt.Sprintf("secret %s was created for a previous service account with the same name, recreating it", existing.Name))
+
+			if err := h.deleteSecret(ctx, sa, existing); err != nil {
+				return ctrl.Result{}, fmt.Errorf("failed to delete stale secret of service account: %w", err)
+			}
+			existing = nil
+		} else if !isLegacySecret(existing, sa) {
+			log.Info("secret holds an expiring token written in renewal mode, replacing it with a long-lived token")
+
+			if err := h.deleteSecret(ctx, sa, existing); err != nil {
+				return ctrl.Result{}, fmt.Errorf("failed to delete renewal secret of service account: %w", err)
+			}
+			existing = nil
+		}
 	}
 
-	return ctrl.Result{}, err
+	if rotationRequested(sa.Annotations) {
+		if err := h.rotate(ctx, sa, existing); err != nil {
+			return ctrl.Result{}, fmt.Errorf("failed to rotate secret for service account: %w", err)
+		}
+
+		return ctrl.Result{}, nil
+	}
+
+	if existing != nil {
+		log.Info("secret already exists for the service account, skipping creation")
+		return ctrl.Result{}, nil
+	}
+
+	log.Info("attempting to create secret for service account")
+
+	if err := h.attemptToCreateSecret(ctx, sa); err != nil {
+		return ctrl.Result{}, fmt.Errorf("failed to create secret for service account: %w", err)
+	}
+
+	recordAction(h.Recorder, log, sa, actionCreateSecret, h.DryRun, fmt.Sprintf("secret %s", TokenSecretName(sa.Name)))
+
+	return ctrl.Result{}, nil
 }
@@ -0,0 +1,106 @@
+package controller
+
+import (
+	"strconv"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"sigs.k8s.io/controller-runtime/pkg/metrics"
+)
+
+var (
+	actionsTotal = prometheus.NewCounterVec(
+		prometheus.CounterOpts{
+			Name: "sa_token_operator_actions_total",
+			Help: "Number of actions taken (or, in dry-run mode, that would have been taken) on service accounts",
+		},
+		[]string{"action", "dry_run"},
+	)
+
+	policyDenialsTotal = prometheus.NewCounterVec(
+		prometheus.CounterOpts{
+			Name: "sa_token_operator_policy_denials_total",
+			Help: "Number of reconciliations where the policy denied managing a service account",
+		},
+		[]string{"mode"},
+	)
+
+	modeConflictsTotal = prometheus.NewCounterVec(
+		prometheus.CounterOpts{
+			Name: "sa_token_operator_mode_conflicts_total",
+			Help: "Number of reconciliations of service accounts annotated with both modes",
+		},
+		[]string{"policy"},
+	)
+
+	suspensionsTotal = prometheus.NewCounterVec(
+		prometheus.CounterOpts{
+			Name: "sa_token_operator_suspensions_total",
+			Help: "Number of times management of a service account was suspended or resumed",
+		},
+		[]string{"transition"},
+	)
+
+	renewalFailuresTotal = prometheus.NewCounterVec(
+		prometheus.CounterOpts{
+			Name: "sa_token_operator_renewal_failures_total",
+			Help: "Number of failed token renewals by the state of the current token (failing, expiring, expired) or terminal",
+		},
+		[]string{"state"},
+	)
+
+	eventsTotal = prometheus.NewCounterVec(
+		prometheus.CounterOpts{
+			Name: "sa_token_operator_watch_events_total",
+			Help: "Number of watch events passed to or filtered from the work queue",
+		},
+		[]string{"kind", "event", "result"},
+	)
+
+	handlerDuration = prometheus.NewHistogramVec(
+		prometheus.HistogramOpts{
+			Name:    "sa_token_operator_handler_duration_seconds",
+			Help:    "Time taken by the handler of each mode to manage a service account",
+			Buckets: prometheus.DefBuckets,
+		},
+		[]string{"mode", "result"},
+	)
+
+	handlerPanicsTotal = prometheus.NewCounterVec(
+		prometheus.CounterOpts{
+			Name: "sa_token_operator_handler_panics_total",
+			Help: "Number of panics recovered from handlers",
+		},
+		[]string{"mode"},
+	)
+
+	missingPermissions = prometheus.NewGaugeVec(
+		prometheus.GaugeOpts{
+			Name: "sa_token_operator_missing_permissions",
+			Help: "Number of permissions the operator is missing by mode (common for the ones every mode needs), found by the last permission check",
+		},
+		[]string{"mode"},
+	)
+
+	orphanedSecrets = prometheus.NewGauge(
+		prometheus.GaugeOpts{
+			Name: "sa_token_operator_orphaned_secrets",
+			Help: "Number of orphaned secrets managed by the operator found by the last garbage collection",
+		},
+	)
+
+	gcErrorsTotal = prometheus.NewCounter(
+		prometheus.CounterOpts{
+			Name: "sa_token_operator_gc_errors_total",
+			Help: "Number of secrets the garbage collection failed to check or delete",
+		},
+	)
+)
+
+func init() {
+	metrics.Registry.MustRegister(actionsTotal, policyDenialsTotal, modeConflictsTotal, suspensionsTotal, renewalFailuresTotal, eventsTotal,
+		handlerDuration, handlerPanicsTotal, missingPermissions, orphanedSecrets, gcErrorsTotal)
+}
+
+func countAction(action string, dryRun bool) {
+	actionsTotal.WithLabelValues(action, strconv.FormatBool(dryRun)).Inc()
+}
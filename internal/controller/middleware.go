@@ -0,0 +1,158 @@
+package controller
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"runtime/debug"
+	"time"
+
+	"go.opentelemetry.io/otel"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/codes"
+	corev1 "k8s.io/api/core/v1"
+	ctrl "sigs.k8s.io/controller-runtime"
+)
+
+type HandlerFunc func(ctx context.Context, sa *corev1.ServiceAccount) (ctrl.Result, error)
+
+func (f HandlerFunc) Handle(ctx context.Context, sa *corev1.ServiceAccount) (ctrl.Result, error) {
+	return f(ctx, sa)
+}
+
+type Middleware func(mode string, next Handler) Handler
+
+// wrappedHandler keeps the handler for findHandler.
+type wrappedHandler struct {
+	Handler
+	inner Handler
+}
+
+func (w *wrappedHandler) Unwrap() Handler {
+	return w.inner
+}
+
+// wrap makes the first middleware the outermost.
+func wrap(mode string, h Handler, middlewares ...Middleware) Handler {
+	wrapped := h
+	for i := len(middlewares) - 1; i >= 0; i-- {
+		wrapped = middlewares[i](mode, wrapped)
+	}
+
+	return &wrappedHandler{Handler: wrapped, inner: h}
+}
+
+// middlewares puts the timeout and the recovery innermost, so the others see their outcome.
+func (r *ServiceAccountReconciler) middlewares() []Middleware {
+	return append([]Middleware{
+		withTracing,
+		withLogging,
+		withMetrics,
+		withEvents(r),
+		withTimeout(r.HandlerTimeout),
+		withRecovery,
+	}, r.Middlewares...)
+}
+
+var tracer = otel.Tracer("github.com/OrRener/service-account-token-operator")
+
+func withTracing(mode string, next Handler) Handler {
+	return HandlerFunc(func(ctx context.Context, sa *corev1.ServiceAccount) (ctrl.Result, error) {
+		ctx, span := tracer.Start(ctx, fmt.Sprintf("handle %s", mode))
+		defer span.End()
+
+		span.SetAttributes(
+			attribute.String("serviceaccount.name", sa.Name),
+			attribute.String("serviceaccount.namespace", sa.Namespace),
+			attribute.String("mode", mode),
+		)
+
+		result, err := next.Handle(ctx, sa)
+		if err != nil {
+			span.RecordError(err)
+			span.SetStatus(codes.Error, err.Error())
+		}
+
+		return result, err
+	})
+}
+
+func withLogging(mode string, next Handler) Handler {
+	return HandlerFunc(func(ctx context.Context, sa *corev1.ServiceAccount) (ctrl.Result, error) {
+		log := ctrl.LoggerFrom(ctx).WithValues("name", sa.Name, "namespace", sa.Namespace, "mode", mode)
+		ctx = ctrl.LoggerInto(ctx, log)
+
+		start := time.Now()
+		result, err := next.Handle(ctx, sa)
+		if err != nil {
+			log.Error(err, "handler failed", "duration", time.Since(start).String())
+			return result, err
+		}
+
+		log.V(1).Info("handler succeeded", "duration", time.Since(start).String(), "requeueAfter", result.RequeueAfter.String())
+
+		return result, nil
+	})
+}
+
+func withMetrics(mode string, next Handler) Handler {
+	return HandlerFunc(func(ctx context.Context, sa *corev1.ServiceAccount) (ctrl.Result, error) {
+		start := time.Now()
+		result, err := next.Handle(ctx, sa)
+
+		outcome := "success"
+		if err != nil {
+			outcome = "error"
+		}
+		handlerDuration.WithLabelValues(mode, outcome).Observe(time.Since(start).Seconds())
+
+		return result, err
+	})
+}
+
+// withEvents leaves blocked service accounts and failed renewals to the reconciler.
+func withEvents(r *ServiceAccountReconciler) Middleware {
+	return func(mode string, next Handler) Handler {
+		return HandlerFunc(func(ctx context.Context, sa *corev1.ServiceAccount) (ctrl.Result, error) {
+			result, err := next.Handle(ctx, sa)
+
+			var blocked *blockedError
+			var renewal *renewalError
+			if err != nil && !errors.As(err, &blocked) && !errors.As(err, &renewal) {
+				recordWarning(r.Recorder, sa, "HandlerFailed", fmt.Sprintf("%s mode: %v", mode, err))
+			}
+
+			return result, err
+		})
+	}
+}
+
+// withTimeout is disabled by a zero timeout.
+func withTimeout(timeout time.Duration) Middleware {
+	return func(_ string, next Handler) Handler {
+		if timeout <= 0 {
+			return next
+		}
+
+		return HandlerFunc(func(ctx context.Context, sa *corev1.ServiceAccount) (ctrl.Result, error) {
+			ctx, cancel := context.WithTimeout(ctx, timeout)
+			defer cancel()
+
+			return next.Handle(ctx, sa)
+		})
+	}
+}
+
+func withRecovery(mode string, next Handler) Handler {
+	return HandlerFunc(func(ctx context.Context, sa *corev1.ServiceAccount) (result ctrl.Result, err error) {
+		defer func() {
+			if p := recover(); p != nil {
+				handlerPanicsTotal.WithLabelValues(mode).Inc()
+				ctrl.LoggerFrom(ctx).Error(nil, "handler panicked", "panic", p, "stack", string(debug.Stack()))
+				result, err = ctrl.Result{}, fmt.Errorf("%s handler panicked: %v", mode, p)
+			}
+		}()
+
+		return next.Handle(ctx, sa)
+	})
+}
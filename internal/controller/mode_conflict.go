@@ -0,0 +1,79 @@
+package controller
+
+import (
+	"context"
+	"fmt"
+
+	"github.com/go-logr/logr"
+	corev1 "k8s.io/api/core/v1"
+)
+
+// Policies for service accounts with both or.io/create-secret and or.io/renew-after.
+const (
+	ConflictReject          = "reject"
+	ConflictPreferRenewal   = "prefer-renewal"
+	ConflictPreferLongLived = "prefer-long-lived"
+)
+
+func ValidateConflictPolicy(policy string) error {
+	switch policy {
+	case ConflictReject, ConflictPreferRenewal, ConflictPreferLongLived:
+		return nil
+	}
+
+	return fmt.Errorf("unknown mode conflict policy %q, must be one of: %s, %s, %s", policy, ConflictReject, ConflictPreferRenewal, ConflictPreferLongLived)
+}
+
+func hasModeConflict(annotations map[string]string) bool {
+	return hasLongLivedAnnotation(annotations) && hasRenewalAnnotation(annotations)
+}
+
+// modeUnderPolicy returns an empty mode when the conflict policy rejects the service account.
+func modeUnderPolicy(annotations map[string]string, conflictPolicy string) string {
+	if !hasModeConflict(annotations) {
+		return ManagementMode(annotations)
+	}
+
+	switch conflictPolicy {
+	case ConflictReject:
+		return ""
+	case ConflictPreferRenewal:
+		return ModeRenewal
+	default:
+		return ModeLongLived
+	}
+}
+
+// resolveMode returns an empty mode when the service account must not be handled.
+func (r *ServiceAccountReconciler) resolveMode(ctx context.Context, sa *corev1.ServiceAccount, log logr.Logger) (string, error) {
+	if !hasModeConflict(sa.Annotations) {
+		return ManagementMode(sa.Annotations), nil
+	}
+
+	conflictPolicy := r.ModeConflictPolicy
+	if conflictPolicy == "" {
+		conflictPolicy = ConflictPreferLongLived
+	}
+
+	modeConflictsTotal.WithLabelValues(conflictPolicy).Inc()
+
+	mode := modeUnderPolicy(sa.Annotations, conflictPolicy)
+	var message string
+	switch mode {
+	case "":
+		message = "service account has both the or.io/create-secret and the or.io/renew-after annotations, remove one of them"
+	case ModeRenewal:
+		message = "service account has both the or.io/create-secret and the or.io/renew-after annotations, using renewal mode"
+	default:
+		message = "service account has both the or.io/create-secret and the or.io/renew-after annotations, using long-lived mode and issuing a non-expiring token"
+	}
+
+	log.Info("conflicting modes annotated on service account", "name", sa.Name, "namespace", sa.Namespace, "policy", conflictPolicy, "mode", mode)
+	recordWarning(r.Recorder, sa, "ModeConflict", message)
+
+	if mode == "" {
+		return "", r.setStatus(ctx, sa, fmt.Sprintf("Rejected: %s", message))
+	}
+
+	return mode, nil
+}
@@ -0,0 +1,93 @@
+package controller
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"slices"
+
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/util/validation"
+	"sigs.k8s.io/yaml"
+)
+
+// NamedTokensAnnotation holds token specs, each renewed in a <service-account-name>-<token-name> secret.
+const NamedTokensAnnotation = "or.io/tokens"
+
+// Formats of the secrets holding named tokens.
+const (
+	// FormatToken uses the keys of the token controller.
+	FormatToken      = "token"
+	FormatKubeconfig = "kubeconfig"
+)
+
+const defaultAudience = "https://kubernetes.default.svc"
+
+type TokenSpec struct {
+	Name      string          `json:"name"`
+	Audiences []string        `json:"audiences,omitempty"`
+	Lifetime  metav1.Duration `json:"lifetime"`
+	Format    string          `json:"format,omitempty"`
+}
+
+func hasNamedTokensAnnotation(annotations map[string]string) bool {
+	return namedTokensMode.enabled(annotations)
+}
+
+func namedTokenSecretName(saName string, tokenName string) string {
+	return fmt.Sprintf("%s-%s", saName, tokenName)
+}
+
+func getTokenSpecs(annotations map[string]string) ([]TokenSpec, error) {
+	var specs []TokenSpec
+	if err := yaml.UnmarshalStrict([]byte(annotations[NamedTokensAnnotation]), &specs); err != nil {
+		return nil, fmt.Errorf("failed to parse %s annotation: %w", NamedTokensAnnotation, err)
+	}
+
+	var names []string
+	for i := range specs {
+		spec := &specs[i]
+
+		if errs := validation.IsDNS1123Label(spec.Name); len(errs) > 0 {
+			return nil, fmt.Errorf("invalid token name %q: %v", spec.Name, errs)
+		}
+
+		// <service-account-name>-token is the secret of the single token modes
+		if spec.Name == "token" {
+			return nil, fmt.Errorf("token name %q is reserved", spec.Name)
+		}
+
+		if slices.Contains(names, spec.Name) {
+			return nil, fmt.Errorf("duplicate token name %q", spec.Name)
+		}
+		names = append(names, spec.Name)
+
+		if spec.Lifetime.Duration < minTokenRequestLifetime {
+			return nil, fmt.Errorf("lifetime of token %q must be at least %s, got %s", spec.Name, minTokenRequestLifetime, spec.Lifetime.Duration)
+		}
+
+		if len(spec.Audiences) == 0 {
+			spec.Audiences = []string{defaultAudience}
+		}
+
+		switch spec.Format {
+		case "":
+			spec.Format = FormatToken
+		case FormatToken, FormatKubeconfig:
+		default:
+			return nil, fmt.Errorf("unknown format %q of token %q, must be one of: %s, %s", spec.Format, spec.Name, FormatToken, FormatKubeconfig)
+		}
+	}
+
+	return specs, nil
+}
+
+// hash changes with the spec, reissuing the token.
+func (s TokenSpec) hash() string {
+	// a struct of strings and durations always marshals
+	data, _ := json.Marshal(s)
+	sum := sha256.Sum256(data)
+
+	return hex.EncodeToString(sum[:8])
+}
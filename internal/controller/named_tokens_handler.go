@@ -0,0 +1,297 @@
+package controller
+
+import (
+	"context"
+	"fmt"
+	"slices"
+	"time"
+
+	authenticationv1 "k8s.io/api/authentication/v1"
+	corev1 "k8s.io/api/core/v1"
+	apierrors "k8s.io/apimachinery/pkg/api/errors"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/types"
+	"k8s.io/client-go/tools/record"
+	"k8s.io/utils/clock"
+	"k8s.io/utils/ptr"
+	ctrl "sigs.k8s.io/controller-runtime"
+	"sigs.k8s.io/controller-runtime/pkg/client"
+)
+
+const (
+	tokenNameLabel      = "or.io/token-name"
+	serviceAccountLabel = "or.io/service-account"
+	tokenSpecAnnotation = "or.io/token-spec"
+)
+
+type NamedTokensHandler struct {
+	client.Client
+	// APIReader defaults to the client.
+	APIReader   client.Reader
+	Recorder    record.EventRecorder
+	Specs       []TokenSpec
+	DryRun      bool
+	AdoptLegacy bool
+	ClusterCA   []byte
+	APIServer   string
+	// MarkRotation is set on the last handler of a service account, the others must see the request.
+	MarkRotation bool
+	Clock        clock.PassiveClock
+}
+
+var namedTokensMode = &managementMode{
+	name:       ModeNamedTokens,
+	order:      30,
+	annotation: NamedTokensAnnotation,
+	additional: true,
+	permissions: []permission{
+		{resource: "serviceaccounts", subresource: "token", verb: "create"},
+		{resource: "secrets", verb: "create"},
+		{resource: "secrets", verb: "patch"},
+		{resource: "secrets", verb: "delete"},
+	},
+	validate: func(annotations map[string]string) error {
+		_, err := getTokenSpecs(annotations)
+		return err
+	},
+	newHandler: func(r *ServiceAccountReconciler, sa *corev1.ServiceAccount, primary bool) (Handler, error) {
+		specs, err := getTokenSpecs(sa.Annotations)
+		if err != nil {
+			return nil, err
+		}
+		return &NamedTokensHandler{Client: r.Client, APIReader: r.APIReader, Recorder: r.Recorder, Specs: specs, DryRun: r.DryRun, AdoptLegacy: r.AdoptLegacySecrets,
+			ClusterCA: r.ClusterCA, APIServer: r.APIServerURL, MarkRotation: primary, Clock: r.Clock}, nil
+	},
+}
+
+func init() {
+	registerMode(namedTokensMode)
+}
+
+func (h *NamedTokensHandler) getSecret(ctx context.Context, sa *corev1.ServiceAccount, name string) (*corev1.Secret, error) {
+	secret := &corev1.Secret{}
+	if err := readerOrClient(h.APIReader, h.Client).Get(ctx, types.NamespacedName{Namespace: sa.Namespace, Name: name}, secret); err != nil {
+		if apierrors.IsNotFound(err) {
+			return nil, nil
+		}
+		return nil, err
+	}
+
+	return secret, nil
+}
+
+func (h *NamedTokensHandler) needsRenewal(now time.Time, sa *corev1.ServiceAccount, spec TokenSpec, secret *corev1.Secret) bool {
+	if secret == nil || rotationRequested(sa.Annotations) || secret.Annotations[tokenSpecAnnotation] != spec.hash() {
+		return true
+	}
+
+	// written for a previous service account with the same name
+	if classifySecret(secret, sa) == secretStale {
+		return true
+	}
+
+	expiration, ok := tokenExpiration(secret.Annotations)
+	if !ok {
+		return true
+	}
+
+	return outlives(now, expiration, spec.Lifetime.Duration) || expiration.Sub(now) < renewalThreshold(spec.Lifetime.Duration)
+}
+
+func (h *NamedTokensHandler) render(sa *corev1.ServiceAccount, spec TokenSpec, token string) (map[string][]byte, error) {
+	if spec.Format == FormatKubeconfig {
+		kubeconfig, err := RenderKubeconfig(h.APIServer, h.ClusterCA, sa.Namespace, sa.Name, token)
+		if err != nil {
+			return nil, err
+		}
+		return map[string][]byte{"kubeconfig": kubeconfig}, nil
+	}
+
+	data := map[string][]byte{
+		"token":     []byte(token),
+		"namespace": []byte(sa.Namespace),
+	}
+	if len(h.ClusterCA) > 0 {
+		data["ca.crt"] = h.ClusterCA
+	}
+
+	return data, nil
+}
+
+func (h *NamedTokensHandler) renew(ctx context.Context, sa *corev1.ServiceAccount, spec TokenSpec, existing *corev1.Secret) (*corev1.Secret, error) {
+	log := ctrl.LoggerFrom(ctx)
+
+	name := namedTokenSecretName(sa.Name, spec.Name)
+	tokenReq := &authenticationv1.TokenRequest{
+		Spec: authenticationv1.TokenRequestSpec{
+			Audiences:         spec.Audiences,
+			ExpirationSeconds: ptr.To(int64(spec.Lifetime.Seconds())),
+		},
+	}
+
+	if !h.DryRun {
+		err := h.SubResource("token").Create(ctx, sa, tokenReq)
+		tokenRequests.record(err)
+		if err != nil {
+			var expiration time.Time
+			if existing != nil {
+				expiration, _ = tokenExpiration(existing.Annotations)
+			}
+			return nil, &renewalError{err: err, expiration: expiration, lifetime: spec.Lifetime.Duration}
+		}
+	}
+	recordAction(h.Recorder, log, sa, actionIssueToken, h.DryRun, fmt.Sprintf("token %s valid for %s", spec.Name, spec.Lifetime.Duration))
+
+	data, err := h.render(sa, spec, tokenReq.Status.Token)
+	if err != nil {
+		return nil, err
+	}
+
+	now := clockOrReal(h.Clock).Now().UTC()
+	secret := &corev1.Secret{
+		ObjectMeta: metav1.ObjectMeta{
+			Name:      name,
+			Namespace: sa.Namespace,
+			Labels: map[string]string{
+				ManagedByLabel:      ManagedByValue,
+				serviceAccountLabel: sa.Name,
+				tokenNameLabel:      spec.Name,
+			},
+			OwnerReferences: []metav1.OwnerReference{tokenSecretOwnerRef(sa)},
+			Annotations: map[string]string{
+				"kubernetes.io/service-account.name": sa.Name,
+				secretModeAnnotation:                 ModeRenewal,
+				tokenSpecAnnotation:                  spec.hash(),
+				"or.io/last-renewal":                 now.Format(time.RFC3339),
+				"or.io/token-expiration":             issuedExpiration(tokenReq, now).UTC().Format(time.RFC3339),
+			},
+		},
+		Data: data,
+		Type: corev1.SecretTypeOpaque,
+	}
+
+	if existing != nil && existing.Type != secret.Type {
+		deleteOpts := append(deleteOptions(h.DryRun), client.Preconditions{UID: &existing.UID})
+		if err := h.Delete(ctx, existing, deleteOpts...); client.IgnoreNotFound(err) != nil {
+			return nil, err
+		}
+		recordAction(h.Recorder, log, sa, actionDeleteSecret, h.DryRun, fmt.Sprintf("secret %s of type %s", existing.Name, existing.Type))
+
+		if h.DryRun {
+			return secret, nil
+		}
+	} else if existing != nil {
+		if err := upgradeManagedFields(ctx, h.Client, existing.DeepCopy(), h.DryRun); err != nil {
+			return nil, err
+		}
+	}
+
+	if err := applySecret(ctx, h.Client, secret, h.DryRun); err != nil {
+		return nil, err
+	}
+	recordAction(h.Recorder, log, sa, actionWriteSecret, h.DryRun, fmt.Sprintf("secret %s", name))
+
+	return secret, nil
+}
+
+// handleSpec returns when the token has to be checked again.
+func (h *NamedTokensHandler) handleSpec(ctx context.Context, sa *corev1.ServiceAccount, spec TokenSpec) (time.Duration, error) {
+	log := ctrl.LoggerFrom(ctx)
+
+	secret, err := h.getSecret(ctx, sa, namedTokenSecretName(sa.Name, spec.Name))
+	if err != nil {
+		return 0, err
+	}
+
+	if secret != nil {
+		claim := &secretClaim{Client: h.Client, Recorder: h.Recorder, AdoptLegacy: h.AdoptLegacy, DryRun: h.DryRun}
+		if err := claim.claim(ctx, sa, secret); err != nil {
+			return 0, err
+		}
+	}
+
+	if h.needsRenewal(clockOrReal(h.Clock).Now(), sa, spec, secret) {
+		log.Info("named token needs renewal", "token", spec.Name)
+
+		secret, err = h.renew(ctx, sa, spec, secret)
+		if err != nil {
+			return 0, err
+		}
+	}
+
+	expiration, _ := tokenExpiration(secret.Annotations)
+
+	return requeuePeriod(clockOrReal(h.Clock).Now(), expiration, spec.Lifetime.Duration), nil
+}
+
+func (h *NamedTokensHandler) cleanup(ctx context.Context, sa *corev1.ServiceAccount) error {
+	log := ctrl.LoggerFrom(ctx)
+
+	secrets := &corev1.SecretList{}
+	if err := h.List(ctx, secrets, client.InNamespace(sa.Namespace), client.MatchingLabels{
+		ManagedByLabel:      ManagedByValue,
+		serviceAccountLabel: sa.Name,
+	}); err != nil {
+		return err
+	}
+
+	for i := range secrets.Items {
+		secret := &secrets.Items[i]
+		tokenName := secret.Labels[tokenNameLabel]
+
+		if slices.ContainsFunc(h.Specs, func(s TokenSpec) bool { return s.Name == tokenName }) || !metav1.IsControlledBy(secret, sa) {
+			continue
+		}
+
+		deleteOpts := append(deleteOptions(h.DryRun), client.Preconditions{UID: &secret.UID})
+		if err := h.Delete(ctx, secret, deleteOpts...); client.IgnoreNotFound(err) != nil {
+			return err
+		}
+		recordAction(h.Recorder, log, sa, actionDeleteSecret, h.DryRun, fmt.Sprintf("secret %s of removed token %s", secret.Name, tokenName))
+	}
+
+	return nil
+}
+
+// cleanupNamedTokens runs when or.io/tokens was removed and the handler is not built.
+func (r *ServiceAccountReconciler) cleanupNamedTokens(ctx context.Context, sa *corev1.ServiceAccount) error {
+	if hasNamedTokensAnnotation(sa.Annotations) {
+		return nil
+	}
+
+	h := &NamedTokensHandler{Client: r.Client, Recorder: r.Recorder, DryRun: r.DryRun}
+	return h.cleanup(ctx, sa)
+}
+
+func (h *NamedTokensHandler) Handle(ctx context.Context, sa *corev1.ServiceAccount) (ctrl.Result, error) {
+	log := ctrl.LoggerFrom(ctx)
+
+	var requeuePeriod time.Duration
+
+	for _, spec := range h.Specs {
+		next, err := h.handleSpec(ctx, sa, spec)
+		if err != nil {
+			return ctrl.Result{}, fmt.Errorf("failed to handle named token %s: %w", spec.Name, err)
+		}
+
+		if requeuePeriod == 0 || next < requeuePeriod {
+			requeuePeriod = next
+		}
+	}
+
+	if err := h.cleanup(ctx, sa); err != nil {
+		return ctrl.Result{}, fmt.Errorf("failed to clean up secrets of removed named tokens: %w", err)
+	}
+
+	if h.MarkRotation && rotationRequested(sa.Annotations) {
+		markRotationHandled(sa.Annotations)
+		if err := applyServiceAccountAnnotations(ctx, h.Client, sa, h.DryRun); err != nil {
+			return ctrl.Result{}, fmt.Errorf("failed to update service account annotation: %w", err)
+		}
+		recordAction(h.Recorder, log, sa, actionUpdateAnnotations, h.DryRun, "rotation annotations")
+	}
+
+	log.Info("requeuing reconciliation for named tokens of service account", "after", requeuePeriod.String())
+
+	return ctrl.Result{RequeueAfter: requeuePeriod}, nil
+}
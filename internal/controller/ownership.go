@@ -0,0 +1,189 @@
+package controller
+
+import (
+	"context"
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"strings"
+
+	corev1 "k8s.io/api/core/v1"
+	apierrors "k8s.io/apimachinery/pkg/api/errors"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/types"
+	"k8s.io/client-go/tools/record"
+	ctrl "sigs.k8s.io/controller-runtime"
+	"sigs.k8s.io/controller-runtime/pkg/client"
+)
+
+// ManagedByLabel marks the secrets managed by the operator.
+const (
+	ManagedByLabel = "app.kubernetes.io/managed-by"
+	ManagedByValue = "service-account-token-operator"
+)
+
+// blockedError is reported instead of retried, the service account needs a human.
+type blockedError struct {
+	reason  string
+	message string
+}
+
+func (e *blockedError) Error() string {
+	return e.message
+}
+
+type secretOwnership int
+
+const (
+	secretOwned secretOwnership = iota
+	secretAdoptable
+	secretForeign
+	// secretStale was created for a previous service account with the same name.
+	secretStale
+	// secretDisowned is managed by the operator for the service account, but lost its owner reference.
+	secretDisowned
+)
+
+func classifySecret(secret *corev1.Secret, sa *corev1.ServiceAccount) secretOwnership {
+	// secrets created before the label was set are only recognizable by their owner reference
+	if metav1.IsControlledBy(secret, sa) {
+		if uid := tokenServiceAccountUID(secret.Data["token"]); uid != "" && uid != sa.UID {
+			return secretStale
+		}
+		return secretOwned
+	}
+
+	// also unlabelled, as written before the label was set
+	if owner := metav1.GetControllerOf(secret); owner != nil && owner.Kind == "ServiceAccount" && owner.Name == sa.Name && owner.UID != sa.UID &&
+		(secret.Labels[ManagedByLabel] == ManagedByValue || secret.Annotations["kubernetes.io/service-account.name"] == sa.Name) {
+		return secretStale
+	}
+
+	if metav1.GetControllerOf(secret) == nil && secret.Labels[ManagedByLabel] == ManagedByValue &&
+		secret.Annotations["kubernetes.io/service-account.name"] == sa.Name {
+		return secretDisowned
+	}
+
+	if metav1.GetControllerOf(secret) == nil &&
+		secret.Type == corev1.SecretTypeServiceAccountToken &&
+		secret.Annotations["kubernetes.io/service-account.name"] == sa.Name {
+		return secretAdoptable
+	}
+
+	return secretForeign
+}
+
+func managedSecretLabels() map[string]string {
+	return map[string]string{ManagedByLabel: ManagedByValue}
+}
+
+func tokenSecretOwnerRef(sa *corev1.ServiceAccount) metav1.OwnerReference {
+	ownerRef := *metav1.NewControllerRef(sa, corev1.SchemeGroupVersion.WithKind("ServiceAccount"))
+	*ownerRef.BlockOwnerDeletion = false
+
+	return ownerRef
+}
+
+// getTokenSecret returns nil when there is no token secret. reader must not be the cache, which
+// only holds the secrets managed by the operator.
+func getTokenSecret(ctx context.Context, reader client.Reader, sa *corev1.ServiceAccount) (*corev1.Secret, error) {
+	secret := &corev1.Secret{}
+	if err := reader.Get(ctx, types.NamespacedName{Namespace: sa.Namespace, Name: TokenSecretName(sa.Name)}, secret); err != nil {
+		if apierrors.IsNotFound(err) {
+			return nil, nil
+		}
+		return nil, err
+	}
+
+	return secret, nil
+}
+
+type secretClaim struct {
+	client.Client
+	Recorder    record.EventRecorder
+	AdoptLegacy bool
+	DryRun      bool
+}
+
+// claim returns a blockedError when the operator may not manage the secret.
+func (c *secretClaim) claim(ctx context.Context, sa *corev1.ServiceAccount, secret *corev1.Secret) error {
+	ownership := classifySecret(secret, sa)
+	switch ownership {
+	case secretOwned, secretStale:
+		return nil
+	case secretDisowned:
+		// written by the operator, so restored whether adoption is enabled or not
+	case secretAdoptable:
+		if !c.AdoptLegacy {
+			return &blockedError{
+				reason:  "SecretNotAdopted",
+				message: fmt.Sprintf("secret %s is a legacy token secret of the service account not managed by the operator, enable adoption of legacy secrets or delete it", secret.Name),
+			}
+		}
+	default:
+		return &blockedError{
+			reason:  "ForeignSecret",
+			message: fmt.Sprintf("secret %s exists and is not managed by the operator for this service account, refusing to touch it", secret.Name),
+		}
+	}
+
+	adopted := &corev1.Secret{
+		ObjectMeta: metav1.ObjectMeta{
+			Name:            secret.Name,
+			Namespace:       secret.Namespace,
+			Labels:          managedSecretLabels(),
+			OwnerReferences: []metav1.OwnerReference{tokenSecretOwnerRef(sa)},
+			Annotations:     map[string]string{},
+		},
+	}
+	if mode, ok := secret.Annotations[secretModeAnnotation]; ok {
+		adopted.Annotations[secretModeAnnotation] = mode
+	} else if ownership == secretAdoptable {
+		// legacy token secrets hold non-expiring tokens
+		adopted.Annotations[secretModeAnnotation] = ModeLongLived
+	}
+
+	if err := applySecret(ctx, c.Client, adopted, c.DryRun); err != nil {
+		return err
+	}
+	adopted.DeepCopyInto(secret)
+
+	description := fmt.Sprintf("legacy secret %s", secret.Name)
+	if ownership == secretDisowned {
+		description = fmt.Sprintf("secret %s whose owner reference was removed", secret.Name)
+	}
+	recordAction(c.Recorder, ctrl.LoggerFrom(ctx), sa, actionAdoptSecret, c.DryRun, description)
+
+	return nil
+}
+
+// tokenServiceAccountUID reads the claims of the JWT without verifying it.
+func tokenServiceAccountUID(token []byte) types.UID {
+	parts := strings.Split(string(token), ".")
+	if len(parts) != 3 {
+		return ""
+	}
+
+	payload, err := base64.RawURLEncoding.DecodeString(parts[1])
+	if err != nil {
+		return ""
+	}
+
+	var claims struct {
+		KubernetesIO struct {
+			ServiceAccount struct {
+				UID types.UID `json:"uid"`
+			} `json:"serviceaccount"`
+		} `json:"kubernetes.io"`
+		// legacy tokens written by the token controller
+		LegacyUID types.UID `json:"kubernetes.io/serviceaccount/service-account.uid"`
+	}
+	if err := json.Unmarshal(payload, &claims); err != nil {
+		return ""
+	}
+
+	if claims.KubernetesIO.ServiceAccount.UID != "" {
+		return claims.KubernetesIO.ServiceAccount.UID
+	}
+	return claims.LegacyUID
+}
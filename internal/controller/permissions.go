@@ -0,0 +1,228 @@
+package controller
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"maps"
+	"net/http"
+	"slices"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/go-logr/logr"
+	authorizationv1 "k8s.io/api/authorization/v1"
+	corev1 "k8s.io/api/core/v1"
+	"sigs.k8s.io/controller-runtime/pkg/client"
+)
+
+type permission struct {
+	group       string
+	resource    string
+	subresource string
+	verb        string
+}
+
+func (p permission) String() string {
+	resource := p.resource
+	if p.subresource != "" {
+		resource = fmt.Sprintf("%s/%s", resource, p.subresource)
+	}
+	if p.group != "" {
+		resource = fmt.Sprintf("%s.%s", resource, p.group)
+	}
+
+	return fmt.Sprintf("%s %s", p.verb, resource)
+}
+
+var commonPermissions = []permission{
+	{resource: "serviceaccounts", verb: "get"},
+	{resource: "serviceaccounts", verb: "list"},
+	{resource: "serviceaccounts", verb: "watch"},
+	{resource: "serviceaccounts", verb: "patch"},
+	{resource: "secrets", verb: "get"},
+	{resource: "secrets", verb: "list"},
+	{resource: "secrets", verb: "watch"},
+	{resource: "events", verb: "create"},
+}
+
+const permissionRetryInterval = 30 * time.Second
+
+// PermissionCheck disables the modes the operator misses permissions for.
+type PermissionCheck struct {
+	Client   client.Client
+	Log      logr.Logger
+	Interval time.Duration
+
+	mu sync.RWMutex
+	// missing is keyed by mode, "" for the common permissions, and nil until a check succeeded.
+	missing map[string][]string
+	err     error
+}
+
+func allowed(ctx context.Context, c client.Client, p permission) (bool, error) {
+	review := &authorizationv1.SelfSubjectAccessReview{
+		Spec: authorizationv1.SelfSubjectAccessReviewSpec{
+			ResourceAttributes: &authorizationv1.ResourceAttributes{
+				Group:       p.group,
+				Resource:    p.resource,
+				Subresource: p.subresource,
+				Verb:        p.verb,
+			},
+		},
+	}
+
+	if err := c.Create(ctx, review); err != nil {
+		return false, err
+	}
+
+	return review.Status.Allowed, nil
+}
+
+func (pc *PermissionCheck) Run(ctx context.Context, c client.Client, log logr.Logger) error {
+	missing := map[string][]string{}
+	check := func(mode string, permissions []permission) error {
+		for _, p := range permissions {
+			ok, err := allowed(ctx, c, p)
+			if err != nil {
+				return fmt.Errorf("failed to review permission %s: %w", p, err)
+			}
+			if !ok {
+				missing[mode] = append(missing[mode], p.String())
+			}
+		}
+		return nil
+	}
+
+	err := check("", commonPermissions)
+	for _, m := range modes {
+		if err != nil {
+			break
+		}
+		err = check(m.name, m.permissions)
+	}
+
+	pc.mu.Lock()
+	defer pc.mu.Unlock()
+
+	pc.err = err
+	if err != nil {
+		return err
+	}
+
+	changed := !maps.EqualFunc(pc.missing, missing, slices.Equal)
+	pc.missing = missing
+
+	missingPermissions.WithLabelValues("common").Set(float64(len(missing[""])))
+	for _, m := range modes {
+		missingPermissions.WithLabelValues(m.name).Set(float64(len(missing[m.name])))
+	}
+
+	if !changed {
+		return nil
+	}
+	if len(missing) == 0 {
+		log.Info("operator has all the permissions it needs")
+	}
+	if len(missing[""]) > 0 {
+		log.Error(nil, "operator is missing permissions needed by every mode", "missing", missing[""])
+	}
+	for _, m := range modes {
+		if len(missing[m.name]) > 0 {
+			log.Error(nil, "operator is missing permissions, disabling mode", "mode", m.name, "missing", missing[m.name])
+		}
+	}
+
+	return nil
+}
+
+// Start runs the check every Interval, zero disables it. A failed check is retried every
+// permissionRetryInterval whatever the Interval.
+func (pc *PermissionCheck) Start(ctx context.Context) error {
+	for {
+		delay := pc.Interval
+		if pc.failed() && (delay <= 0 || delay > permissionRetryInterval) {
+			delay = permissionRetryInterval
+		}
+
+		if delay <= 0 {
+			<-ctx.Done()
+			return nil
+		}
+
+		select {
+		case <-ctx.Done():
+			return nil
+		case <-time.After(delay):
+		}
+
+		if err := pc.Run(ctx, pc.Client, pc.Log); err != nil {
+			pc.Log.Error(err, "failed to check the permissions of the operator, retrying", "after", permissionRetryInterval.String())
+		}
+	}
+}
+
+// NeedLeaderElection is false, every replica checks its readiness.
+func (pc *PermissionCheck) NeedLeaderElection() bool {
+	return false
+}
+
+func (pc *PermissionCheck) failed() bool {
+	pc.mu.RLock()
+	defer pc.mu.RUnlock()
+
+	return pc.err != nil
+}
+
+func (pc *PermissionCheck) Missing(mode string) []string {
+	if pc == nil {
+		return nil
+	}
+
+	pc.mu.RLock()
+	defer pc.mu.RUnlock()
+
+	return slices.Concat(pc.missing[""], pc.missing[mode])
+}
+
+// Check fails while no mode is usable, or until the permissions could be reviewed.
+func (pc *PermissionCheck) Check(_ *http.Request) error {
+	pc.mu.RLock()
+	defer pc.mu.RUnlock()
+
+	if pc.missing == nil {
+		return pc.err
+	}
+
+	if len(pc.missing[""]) > 0 {
+		return fmt.Errorf("missing permissions needed by every mode: %s", strings.Join(pc.missing[""], ", "))
+	}
+	for _, m := range modes {
+		if len(pc.missing[m.name]) == 0 {
+			return nil
+		}
+	}
+
+	return errors.New("every mode is disabled by missing permissions")
+}
+
+func (r *ServiceAccountReconciler) checkPermissions(ctx context.Context, sa *corev1.ServiceAccount, mode string, log logr.Logger) (bool, error) {
+	var missing []string
+	for _, m := range enabledModes(sa.Annotations, mode) {
+		missing = append(missing, r.Permissions.Missing(m.name)...)
+	}
+
+	if len(missing) == 0 {
+		return false, nil
+	}
+
+	slices.Sort(missing)
+	missing = slices.Compact(missing)
+
+	message := fmt.Sprintf("the operator is missing permissions: %s", strings.Join(missing, ", "))
+	log.Info("mode of service account is disabled", "name", sa.Name, "namespace", sa.Namespace, "mode", mode, "missing", missing)
+	recordWarning(r.Recorder, sa, "ModeDisabled", message)
+
+	return true, r.setStatus(ctx, sa, fmt.Sprintf("Disabled: %s", message))
+}
@@ -0,0 +1,242 @@
+package controller
+
+import (
+	"context"
+	"fmt"
+	"os"
+	"path"
+	"slices"
+	"time"
+
+	corev1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/labels"
+	"k8s.io/apimachinery/pkg/types"
+	"sigs.k8s.io/controller-runtime/pkg/client"
+	"sigs.k8s.io/yaml"
+)
+
+// PolicyRule selects service accounts by namespace labels and name patterns, empty ones match everything.
+type PolicyRule struct {
+	Name                string                `json:"name"`
+	NamespaceSelector   *metav1.LabelSelector `json:"namespaceSelector,omitempty"`
+	ServiceAccountNames []string              `json:"serviceAccountNames,omitempty"`
+	// AllowedModes are all modes when empty.
+	AllowedModes     []string         `json:"allowedModes,omitempty"`
+	MaxRenewalPeriod *metav1.Duration `json:"maxRenewalPeriod,omitempty"`
+	MinRenewalPeriod *metav1.Duration `json:"minRenewalPeriod,omitempty"`
+}
+
+// Policy rules apply in order, the first one selecting a service account wins.
+type Policy struct {
+	Rules []PolicyRule `json:"rules,omitempty"`
+	// PrivilegedClusterRoles may not be bound to service accounts with long-lived tokens.
+	PrivilegedClusterRoles    []string          `json:"privilegedClusterRoles,omitempty"`
+	PrivilegedServiceAccounts *PrivilegedPolicy `json:"privilegedServiceAccounts,omitempty"`
+	// MinRenewalPeriod also applies to named token lifetimes.
+	MinRenewalPeriod *metav1.Duration `json:"minRenewalPeriod,omitempty"`
+}
+
+const defaultMinRenewalPeriod = 24 * time.Hour
+
+// Actions taken for privileged service accounts.
+const (
+	PrivilegedBlock           = "Block"
+	PrivilegedRequireApproval = "RequireApproval"
+	PrivilegedCapLifetime     = "CapLifetime"
+)
+
+type PrivilegedPolicy struct {
+	Action      string           `json:"action"`
+	MaxLifetime *metav1.Duration `json:"maxLifetime,omitempty"`
+}
+
+type policyDecision struct {
+	// denial is empty when the service account is allowed.
+	denial      string
+	lifetimeCap time.Duration
+	capReason   string
+}
+
+func LoadPolicy(file string) (*Policy, error) {
+	data, err := os.ReadFile(file)
+	if err != nil {
+		return nil, err
+	}
+
+	policy := &Policy{}
+	if err := yaml.UnmarshalStrict(data, policy); err != nil {
+		return nil, fmt.Errorf("failed to parse policy file %s: %w", file, err)
+	}
+
+	if err := policy.validate(); err != nil {
+		return nil, fmt.Errorf("invalid policy file %s: %w", file, err)
+	}
+
+	return policy, nil
+}
+
+func (p *Policy) validate() error {
+	if err := validateMinRenewalPeriod(p.MinRenewalPeriod); err != nil {
+		return err
+	}
+
+	for _, rule := range p.Rules {
+		if err := validateMinRenewalPeriod(rule.MinRenewalPeriod); err != nil {
+			return fmt.Errorf("rule %q: %w", rule.Name, err)
+		}
+
+		if _, err := metav1.LabelSelectorAsSelector(rule.NamespaceSelector); err != nil {
+			return fmt.Errorf("rule %q: %w", rule.Name, err)
+		}
+
+		for _, pattern := range rule.ServiceAccountNames {
+			if _, err := path.Match(pattern, ""); err != nil {
+				return fmt.Errorf("rule %q: invalid service account name pattern %q: %w", rule.Name, pattern, err)
+			}
+		}
+
+		for _, mode := range rule.AllowedModes {
+			if mode != ModeLongLived && mode != ModeRenewal {
+				return fmt.Errorf("rule %q: unknown mode %q", rule.Name, mode)
+			}
+		}
+	}
+
+	if privileged := p.PrivilegedServiceAccounts; privileged != nil {
+		switch privileged.Action {
+		case PrivilegedBlock, PrivilegedRequireApproval:
+		case PrivilegedCapLifetime:
+			if privileged.MaxLifetime == nil || privileged.MaxLifetime.Duration < minTokenRequestLifetime {
+				return fmt.Errorf("privilegedServiceAccounts: the CapLifetime action requires a maxLifetime of at least %s", minTokenRequestLifetime)
+			}
+		default:
+			return fmt.Errorf("privilegedServiceAccounts: unknown action %q", privileged.Action)
+		}
+	}
+
+	return nil
+}
+
+func validateMinRenewalPeriod(minimum *metav1.Duration) error {
+	if minimum != nil && minimum.Duration < minTokenRequestLifetime {
+		return fmt.Errorf("minRenewalPeriod must be at least %s", minTokenRequestLifetime)
+	}
+	return nil
+}
+
+func (rule *PolicyRule) selects(sa *corev1.ServiceAccount, ns *corev1.Namespace) bool {
+	// validated when the policy was loaded
+	selector, _ := metav1.LabelSelectorAsSelector(rule.NamespaceSelector)
+	if rule.NamespaceSelector != nil && !selector.Matches(labels.Set(ns.Labels)) {
+		return false
+	}
+
+	if len(rule.ServiceAccountNames) == 0 {
+		return true
+	}
+
+	return slices.ContainsFunc(rule.ServiceAccountNames, func(pattern string) bool {
+		matched, _ := path.Match(pattern, sa.Name)
+		return matched
+	})
+}
+
+// evaluatePolicy decides for all the tokens of the service account at once, renewalPeriods holds the
+// lifetimes of its expiring tokens.
+func evaluatePolicy(ctx context.Context, c client.Client, policy *Policy, sa *corev1.ServiceAccount, modes []string, renewalPeriods []time.Duration) (policyDecision, error) {
+	if policy == nil {
+		policy = &Policy{}
+	}
+
+	minRenewalPeriod := defaultMinRenewalPeriod
+	if policy.MinRenewalPeriod != nil {
+		minRenewalPeriod = policy.MinRenewalPeriod.Duration
+	}
+
+	if len(policy.Rules) > 0 {
+		ns := &corev1.Namespace{}
+		if err := c.Get(ctx, types.NamespacedName{Name: sa.Namespace}, ns); err != nil {
+			return policyDecision{}, err
+		}
+
+		for _, rule := range policy.Rules {
+			if !rule.selects(sa, ns) {
+				continue
+			}
+
+			for _, mode := range modes {
+				if len(rule.AllowedModes) > 0 && !slices.Contains(rule.AllowedModes, mode) {
+					return policyDecision{denial: fmt.Sprintf("%s tokens are not allowed by policy rule %q", mode, rule.Name)}, nil
+				}
+			}
+
+			for _, renewalPeriod := range renewalPeriods {
+				if rule.MaxRenewalPeriod != nil && renewalPeriod > rule.MaxRenewalPeriod.Duration {
+					return policyDecision{denial: fmt.Sprintf("renewal period %s exceeds the maximum of %s allowed by policy rule %q", renewalPeriod, rule.MaxRenewalPeriod.Duration, rule.Name)}, nil
+				}
+			}
+
+			if rule.MinRenewalPeriod != nil {
+				minRenewalPeriod = rule.MinRenewalPeriod.Duration
+			}
+
+			break
+		}
+	}
+
+	for _, renewalPeriod := range renewalPeriods {
+		if renewalPeriod < minRenewalPeriod {
+			return policyDecision{denial: fmt.Sprintf("renewal period %s is below the minimum of %s allowed by policy", renewalPeriod, minRenewalPeriod)}, nil
+		}
+	}
+
+	longLived := slices.Contains(modes, ModeLongLived)
+	if longLived && len(policy.PrivilegedClusterRoles) > 0 {
+		role, err := boundPrivilegedClusterRole(ctx, c, sa, policy.PrivilegedClusterRoles)
+		if err != nil {
+			return policyDecision{}, err
+		}
+
+		if role != "" {
+			return policyDecision{denial: fmt.Sprintf("long-lived tokens are not allowed for service accounts bound to the privileged cluster role %q", role)}, nil
+		}
+	}
+
+	if policy.PrivilegedServiceAccounts != nil {
+		return evaluatePrivileged(ctx, c, policy.PrivilegedServiceAccounts, sa, longLived)
+	}
+
+	return policyDecision{}, nil
+}
+
+func evaluatePrivileged(ctx context.Context, c client.Client, privileged *PrivilegedPolicy, sa *corev1.ServiceAccount, longLived bool) (policyDecision, error) {
+	findings, err := privilegedPermissions(ctx, c, sa)
+	if err != nil {
+		return policyDecision{}, err
+	}
+
+	if len(findings) == 0 {
+		return policyDecision{}, nil
+	}
+
+	summary := findings[0]
+	if len(findings) > 1 {
+		summary = fmt.Sprintf("%s (and %d more)", summary, len(findings)-1)
+	}
+
+	switch privileged.Action {
+	case PrivilegedRequireApproval:
+		if _, ok := sa.Annotations["or.io/privileged-approval"]; ok {
+			return policyDecision{}, nil
+		}
+		return policyDecision{denial: fmt.Sprintf("service account is privileged and requires the or.io/privileged-approval annotation: %s", summary)}, nil
+	case PrivilegedCapLifetime:
+		if longLived {
+			return policyDecision{denial: fmt.Sprintf("long-lived tokens are not allowed for privileged service accounts: %s", summary)}, nil
+		}
+		return policyDecision{lifetimeCap: privileged.MaxLifetime.Duration, capReason: summary}, nil
+	default:
+		return policyDecision{denial: fmt.Sprintf("tokens are not allowed for privileged service accounts: %s", summary)}, nil
+	}
+}
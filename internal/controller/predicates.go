@@ -0,0 +1,105 @@
+package controller
+
+import (
+	"maps"
+	"slices"
+
+	"k8s.io/apimachinery/pkg/api/equality"
+	"sigs.k8s.io/controller-runtime/pkg/client"
+	"sigs.k8s.io/controller-runtime/pkg/event"
+	"sigs.k8s.io/controller-runtime/pkg/predicate"
+)
+
+// commonConfigAnnotations apply to every mode, the annotations of each mode come from the registry.
+var commonConfigAnnotations = []string{
+	RotateAnnotation,
+	SuspendAnnotation,
+	"or.io/privileged-approval",
+}
+
+func configChanged(oldObj, newObj client.Object) bool {
+	changed := func(key string) bool {
+		oldVal, oldOk := oldObj.GetAnnotations()[key]
+		newVal, newOk := newObj.GetAnnotations()[key]
+		return oldOk != newOk || oldVal != newVal
+	}
+
+	for _, m := range modes {
+		if changed(m.annotation) {
+			return true
+		}
+	}
+
+	return slices.ContainsFunc(commonConfigAnnotations, changed) ||
+		oldObj.GetLabels()[OptInLabel] != newObj.GetLabels()[OptInLabel]
+}
+
+func countEvents(kind string, p predicate.Funcs) predicate.Funcs {
+	count := func(event string, passed bool) bool {
+		result := "filtered"
+		if passed {
+			result = "passed"
+		}
+		eventsTotal.WithLabelValues(kind, event, result).Inc()
+		return passed
+	}
+
+	return predicate.Funcs{
+		CreateFunc:  func(e event.CreateEvent) bool { return count("create", p.Create(e)) },
+		UpdateFunc:  func(e event.UpdateEvent) bool { return count("update", p.Update(e)) },
+		DeleteFunc:  func(e event.DeleteEvent) bool { return count("delete", p.Delete(e)) },
+		GenericFunc: func(e event.GenericEvent) bool { return count("generic", p.Generic(e)) },
+	}
+}
+
+// serviceAccountPredicate lets resyncs through, they retry the terminal failures.
+func serviceAccountPredicate() predicate.Funcs {
+	managed := func(obj client.Object) bool {
+		return ManagementMode(obj.GetAnnotations()) != ""
+	}
+
+	return countEvents("ServiceAccount", predicate.Funcs{
+		CreateFunc: func(e event.CreateEvent) bool {
+			return managed(e.Object)
+		},
+		UpdateFunc: func(e event.UpdateEvent) bool {
+			if !managed(e.ObjectOld) && !managed(e.ObjectNew) {
+				return false
+			}
+			resync := e.ObjectOld.GetResourceVersion() == e.ObjectNew.GetResourceVersion()
+			return resync || e.ObjectOld.GetUID() != e.ObjectNew.GetUID() || configChanged(e.ObjectOld, e.ObjectNew)
+		},
+		DeleteFunc: func(e event.DeleteEvent) bool {
+			return false
+		},
+		GenericFunc: func(e event.GenericEvent) bool {
+			return managed(e.Object)
+		},
+	})
+}
+
+// ownedSecretPredicate passes the secrets the operator has to repair.
+func ownedSecretPredicate() predicate.Funcs {
+	managed := func(obj client.Object) bool {
+		return obj.GetLabels()[ManagedByLabel] == ManagedByValue
+	}
+
+	return countEvents("Secret", predicate.Funcs{
+		CreateFunc: func(e event.CreateEvent) bool {
+			return false
+		},
+		UpdateFunc: func(e event.UpdateEvent) bool {
+			if !managed(e.ObjectOld) {
+				return false
+			}
+			return !maps.Equal(e.ObjectOld.GetLabels(), e.ObjectNew.GetLabels()) ||
+				!equality.Semantic.DeepEqual(e.ObjectOld.GetOwnerReferences(), e.ObjectNew.GetOwnerReferences())
+		},
+		DeleteFunc: func(e event.DeleteEvent) bool {
+			return managed(e.Object)
+		},
+		GenericFunc: func(e event.GenericEvent) bool {
+			return false
+		},
+	})
+}
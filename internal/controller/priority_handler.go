@@ -0,0 +1,114 @@
+package controller
+
+import (
+	"context"
+	"time"
+
+	corev1 "k8s.io/api/core/v1"
+	"k8s.io/apimachinery/pkg/types"
+	"k8s.io/client-go/util/workqueue"
+	"k8s.io/utils/clock"
+	"sigs.k8s.io/controller-runtime/pkg/client"
+	"sigs.k8s.io/controller-runtime/pkg/controller/priorityqueue"
+	"sigs.k8s.io/controller-runtime/pkg/event"
+	"sigs.k8s.io/controller-runtime/pkg/reconcile"
+)
+
+// maxExpiryHorizon is how far in the future an expiration still raises the priority.
+const maxExpiryHorizon = 365 * 24 * time.Hour
+
+// expiryPriority is higher the sooner a token expires, and highest when an expiration cannot be read.
+// namedExpirations holds the expirations of the named tokens by token name.
+func expiryPriority(annotations map[string]string, namedExpirations map[string]time.Time, now time.Time) int {
+	horizon := int(maxExpiryHorizon / time.Minute)
+
+	priority := func(expiration time.Time) int {
+		remaining := int(expiration.Sub(now) / time.Minute)
+		remaining = max(0, min(remaining, horizon))
+
+		return horizon - remaining
+	}
+
+	var highest int
+	if hasRenewalAnnotation(annotations) {
+		expiration, ok := tokenExpiration(annotations)
+		if !ok {
+			return horizon + 1
+		}
+		highest = priority(expiration)
+	}
+
+	if hasNamedTokensAnnotation(annotations) {
+		specs, err := getTokenSpecs(annotations)
+		if err != nil {
+			return horizon + 1
+		}
+
+		for _, spec := range specs {
+			expiration, ok := namedExpirations[spec.Name]
+			if !ok {
+				return horizon + 1
+			}
+			highest = max(highest, priority(expiration))
+		}
+	}
+
+	return highest
+}
+
+// enqueueByExpiry reconciles near-expiry tokens first after a restart or while working through a backlog.
+type enqueueByExpiry struct {
+	clock clock.PassiveClock
+	// reader lists the secrets of named tokens, their expirations are only stored there.
+	reader client.Reader
+}
+
+func (e *enqueueByExpiry) namedExpirations(ctx context.Context, obj client.Object) map[string]time.Time {
+	if e.reader == nil || !hasNamedTokensAnnotation(obj.GetAnnotations()) {
+		return nil
+	}
+
+	secrets := &corev1.SecretList{}
+	if err := e.reader.List(ctx, secrets, client.InNamespace(obj.GetNamespace()),
+		client.MatchingLabels{ManagedByLabel: ManagedByValue, serviceAccountLabel: obj.GetName()}, client.HasLabels{tokenNameLabel}); err != nil {
+		return nil
+	}
+
+	expirations := map[string]time.Time{}
+	for _, secret := range secrets.Items {
+		if expiration, ok := tokenExpiration(secret.Annotations); ok {
+			expirations[secret.Labels[tokenNameLabel]] = expiration
+		}
+	}
+
+	return expirations
+}
+
+func (e *enqueueByExpiry) add(ctx context.Context, obj client.Object, q workqueue.TypedRateLimitingInterface[reconcile.Request]) {
+	req := reconcile.Request{NamespacedName: types.NamespacedName{Name: obj.GetName(), Namespace: obj.GetNamespace()}}
+
+	pq, ok := q.(priorityqueue.PriorityQueue[reconcile.Request])
+	if !ok {
+		q.Add(req)
+		return
+	}
+
+	priority := expiryPriority(obj.GetAnnotations(), e.namedExpirations(ctx, obj), clockOrReal(e.clock).Now())
+	pq.AddWithOpts(priorityqueue.AddOpts{Priority: priority}, req)
+}
+
+func (e *enqueueByExpiry) Create(ctx context.Context, evt event.CreateEvent, q workqueue.TypedRateLimitingInterface[reconcile.Request]) {
+	e.add(ctx, evt.Object, q)
+}
+
+func (e *enqueueByExpiry) Update(ctx context.Context, evt event.UpdateEvent, q workqueue.TypedRateLimitingInterface[reconcile.Request]) {
+	e.add(ctx, evt.ObjectNew, q)
+}
+
+func (e *enqueueByExpiry) Delete(ctx context.Context, evt event.DeleteEvent, q workqueue.TypedRateLimitingInterface[reconcile.Request]) {
+	e.add(ctx, evt.Object, q)
+}
+
+func (e *enqueueByExpiry) Generic(ctx context.Context, evt event.GenericEvent, q workqueue.TypedRateLimitingInterface[reconcile.Request]) {
+	e.add(ctx, evt.Object, q)
+}
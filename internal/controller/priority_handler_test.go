@@ -0,0 +1,57 @@
+package controller
+
+import (
+	"testing"
+	"time"
+)
+
+func TestExpiryPriority(t *testing.T) {
+	now := time.Now()
+	horizon := int(maxExpiryHorizon / time.Minute)
+	named := map[string]string{NamedTokensAnnotation: "- name: ci\n  lifetime: 1h\n- name: deploy\n  lifetime: 24h\n"}
+
+	tests := []struct {
+		name             string
+		annotations      map[string]string
+		namedExpirations map[string]time.Time
+		want             int
+	}{
+		{
+			name:        "long-lived",
+			annotations: map[string]string{"or.io/create-secret": "true"},
+			want:        0,
+		},
+		{
+			name:        "renewal without expiration",
+			annotations: map[string]string{"or.io/renew-after": "24h"},
+			want:        horizon + 1,
+		},
+		{
+			name:        "renewal",
+			annotations: map[string]string{"or.io/renew-after": "24h", "or.io/token-expiration": now.Add(time.Hour).Format(time.RFC3339)},
+			want:        horizon - 60,
+		},
+		{
+			name:             "named token not issued yet",
+			annotations:      named,
+			namedExpirations: map[string]time.Time{"ci": now.Add(time.Hour)},
+			want:             horizon + 1,
+		},
+		{
+			name:             "named tokens",
+			annotations:      named,
+			namedExpirations: map[string]time.Time{"ci": now.Add(time.Hour), "deploy": now.Add(10 * time.Hour)},
+			want:             horizon - 60,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			// the expirations are formatted with second resolution
+			got := expiryPriority(tt.annotations, tt.namedExpirations, now.Truncate(time.Second))
+			if got != tt.want {
+				t.Errorf("expiryPriority() = %d, want %d", got, tt.want)
+			}
+		})
+	}
+}
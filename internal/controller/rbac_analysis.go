@@ -0,0 +1,204 @@
+package controller
+
+import (
+	"context"
+	"fmt"
+	"slices"
+
+	corev1 "k8s.io/api/core/v1"
+	rbacv1 "k8s.io/api/rbac/v1"
+	apierrors "k8s.io/apimachinery/pkg/api/errors"
+	"k8s.io/apimachinery/pkg/types"
+	"k8s.io/apiserver/pkg/authentication/serviceaccount"
+	"sigs.k8s.io/controller-runtime/pkg/client"
+)
+
+type boundRole struct {
+	Kind      string
+	Name      string
+	Namespace string
+	Binding   string
+}
+
+func (b boundRole) String() string {
+	if b.Kind == "Role" {
+		return fmt.Sprintf("role %s/%s (bound by %s)", b.Namespace, b.Name, b.Binding)
+	}
+	return fmt.Sprintf("cluster role %s (bound by %s)", b.Name, b.Binding)
+}
+
+// isBindingSubject also matches the system:serviceaccounts groups and the username of the service
+// account. A service account subject without namespace is in the namespace of the RoleBinding,
+// bindingNamespace is empty for a ClusterRoleBinding.
+func isBindingSubject(subjects []rbacv1.Subject, bindingNamespace string, sa *corev1.ServiceAccount) bool {
+	groups := []string{"system:serviceaccounts", fmt.Sprintf("system:serviceaccounts:%s", sa.Namespace), "system:authenticated"}
+
+	return slices.ContainsFunc(subjects, func(s rbacv1.Subject) bool {
+		switch s.Kind {
+		case rbacv1.ServiceAccountKind:
+			namespace := s.Namespace
+			if namespace == "" {
+				namespace = bindingNamespace
+			}
+			return s.Name == sa.Name && namespace == sa.Namespace
+		case rbacv1.UserKind:
+			return s.Name == serviceaccount.MakeUsername(sa.Namespace, sa.Name)
+		case rbacv1.GroupKind:
+			return slices.Contains(groups, s.Name)
+		}
+		return false
+	})
+}
+
+func boundRoles(ctx context.Context, c client.Client, sa *corev1.ServiceAccount) ([]boundRole, error) {
+	var roles []boundRole
+
+	clusterRoleBindings := &rbacv1.ClusterRoleBindingList{}
+	if err := c.List(ctx, clusterRoleBindings); err != nil {
+		return nil, err
+	}
+
+	for _, binding := range clusterRoleBindings.Items {
+		if isBindingSubject(binding.Subjects, "", sa) {
+			roles = append(roles, boundRole{
+				Kind:    binding.RoleRef.Kind,
+				Name:    binding.RoleRef.Name,
+				Binding: fmt.Sprintf("ClusterRoleBinding %s", binding.Name),
+			})
+		}
+	}
+
+	roleBindings := &rbacv1.RoleBindingList{}
+	if err := c.List(ctx, roleBindings, client.InNamespace(sa.Namespace)); err != nil {
+		return nil, err
+	}
+
+	for _, binding := range roleBindings.Items {
+		if isBindingSubject(binding.Subjects, binding.Namespace, sa) {
+			role := boundRole{
+				Kind:    binding.RoleRef.Kind,
+				Name:    binding.RoleRef.Name,
+				Binding: fmt.Sprintf("RoleBinding %s/%s", binding.Namespace, binding.Name),
+			}
+			if role.Kind == "Role" {
+				role.Namespace = binding.Namespace
+			}
+			roles = append(roles, role)
+		}
+	}
+
+	return roles, nil
+}
+
+func boundPrivilegedClusterRole(ctx context.Context, c client.Client, sa *corev1.ServiceAccount, privileged []string) (string, error) {
+	roles, err := boundRoles(ctx, c, sa)
+	if err != nil {
+		return "", err
+	}
+
+	for _, role := range roles {
+		if role.Kind == "ClusterRole" && slices.Contains(privileged, role.Name) {
+			return role.Name, nil
+		}
+	}
+
+	return "", nil
+}
+
+func (b boundRole) rules(ctx context.Context, c client.Client) ([]rbacv1.PolicyRule, error) {
+	if b.Kind == "Role" {
+		role := &rbacv1.Role{}
+		if err := c.Get(ctx, types.NamespacedName{Namespace: b.Namespace, Name: b.Name}, role); err != nil {
+			return nil, err
+		}
+		return role.Rules, nil
+	}
+
+	clusterRole := &rbacv1.ClusterRole{}
+	if err := c.Get(ctx, types.NamespacedName{Name: b.Name}, clusterRole); err != nil {
+		return nil, err
+	}
+	return clusterRole.Rules, nil
+}
+
+func matching(values []string, candidates ...string) []string {
+	var matched []string
+	for _, v := range values {
+		if v == rbacv1.VerbAll || slices.Contains(candidates, v) {
+			matched = append(matched, v)
+		}
+	}
+	return matched
+}
+
+var writeVerbs = []string{"create", "update", "patch", "delete", "deletecollection"}
+
+// privilegedRule returns what makes the rule privileged, empty when it is not.
+func privilegedRule(rule rbacv1.PolicyRule) string {
+	if len(rule.NonResourceURLs) > 0 {
+		return ""
+	}
+
+	// a wildcard also covers every resource added in the future
+	if slices.Contains(rule.Resources, rbacv1.ResourceAll) {
+		return fmt.Sprintf("%v on all resources of the API groups %v", rule.Verbs, rule.APIGroups)
+	}
+	if verbs := matching(rule.Verbs, "escalate", "bind", "impersonate"); len(verbs) > 0 {
+		return fmt.Sprintf("%v on %v", verbs, rule.Resources)
+	}
+	if slices.Contains(rule.APIGroups, rbacv1.APIGroupAll) {
+		if verbs := matching(rule.Verbs, writeVerbs...); len(verbs) > 0 {
+			return fmt.Sprintf("%v on %v of all API groups", verbs, rule.Resources)
+		}
+	}
+
+	type sensitive struct {
+		groups    []string
+		resources []string
+		verbs     []string
+	}
+	for _, s := range []sensitive{
+		{groups: []string{""}, resources: []string{"secrets"}, verbs: []string{"get", "list", "watch"}},
+		{groups: []string{""}, resources: []string{"serviceaccounts/token", "pods/exec", "nodes/proxy"}, verbs: []string{"create"}},
+		{groups: []string{rbacv1.GroupName}, resources: []string{"roles", "clusterroles", "rolebindings", "clusterrolebindings"}, verbs: []string{"create", "update", "patch"}},
+		// workloads can mount any secret or token of their namespace
+		{groups: []string{""}, resources: []string{"pods", "replicationcontrollers"}, verbs: []string{"create"}},
+		{groups: []string{"apps"}, resources: []string{"deployments", "daemonsets", "statefulsets", "replicasets"}, verbs: []string{"create"}},
+		{groups: []string{"batch"}, resources: []string{"jobs", "cronjobs"}, verbs: []string{"create"}},
+	} {
+		resources := matching(rule.Resources, s.resources...)
+		verbs := matching(rule.Verbs, s.verbs...)
+		if len(matching(rule.APIGroups, s.groups...)) > 0 && len(resources) > 0 && len(verbs) > 0 {
+			return fmt.Sprintf("%v on %v", verbs, resources)
+		}
+	}
+
+	return ""
+}
+
+func privilegedPermissions(ctx context.Context, c client.Client, sa *corev1.ServiceAccount) ([]string, error) {
+	roles, err := boundRoles(ctx, c, sa)
+	if err != nil {
+		return nil, err
+	}
+
+	var findings []string
+	for _, role := range roles {
+		rules, err := role.rules(ctx, c)
+		if err != nil {
+			// a binding to a role that does not exist grants nothing
+			if apierrors.IsNotFound(err) {
+				continue
+			}
+			return nil, err
+		}
+
+		for _, rule := range rules {
+			if finding := privilegedRule(rule); finding != "" {
+				findings = append(findings, fmt.Sprintf("%s grants %s", role, finding))
+			}
+		}
+	}
+
+	return findings, nil
+}
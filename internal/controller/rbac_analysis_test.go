@@ -0,0 +1,179 @@
+package controller
+
+import (
+	"strings"
+	"testing"
+
+	corev1 "k8s.io/api/core/v1"
+	rbacv1 "k8s.io/api/rbac/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+)
+
+func TestIsBindingSubject(t *testing.T) {
+	sa := &corev1.ServiceAccount{ObjectMeta: metav1.ObjectMeta{Name: "app", Namespace: "team"}}
+
+	tests := []struct {
+		name             string
+		subject          rbacv1.Subject
+		bindingNamespace string
+		want             bool
+	}{
+		{
+			name:    "service account",
+			subject: rbacv1.Subject{Kind: rbacv1.ServiceAccountKind, Name: "app", Namespace: "team"},
+			want:    true,
+		},
+		{
+			name:    "service account of another namespace",
+			subject: rbacv1.Subject{Kind: rbacv1.ServiceAccountKind, Name: "app", Namespace: "other"},
+			want:    false,
+		},
+		{
+			name:             "service account without namespace in a role binding",
+			subject:          rbacv1.Subject{Kind: rbacv1.ServiceAccountKind, Name: "app"},
+			bindingNamespace: "team",
+			want:             true,
+		},
+		{
+			name:             "service account without namespace in a role binding of another namespace",
+			subject:          rbacv1.Subject{Kind: rbacv1.ServiceAccountKind, Name: "app"},
+			bindingNamespace: "other",
+			want:             false,
+		},
+		{
+			name:    "service account without namespace in a cluster role binding",
+			subject: rbacv1.Subject{Kind: rbacv1.ServiceAccountKind, Name: "app"},
+			want:    false,
+		},
+		{
+			name:    "username of the service account",
+			subject: rbacv1.Subject{Kind: rbacv1.UserKind, APIGroup: rbacv1.GroupName, Name: "system:serviceaccount:team:app"},
+			want:    true,
+		},
+		{
+			name:    "username of another service account",
+			subject: rbacv1.Subject{Kind: rbacv1.UserKind, APIGroup: rbacv1.GroupName, Name: "system:serviceaccount:team:other"},
+			want:    false,
+		},
+		{
+			name:    "user named like the service account",
+			subject: rbacv1.Subject{Kind: rbacv1.UserKind, APIGroup: rbacv1.GroupName, Name: "app"},
+			want:    false,
+		},
+		{
+			name:    "service accounts of the namespace",
+			subject: rbacv1.Subject{Kind: rbacv1.GroupKind, APIGroup: rbacv1.GroupName, Name: "system:serviceaccounts:team"},
+			want:    true,
+		},
+		{
+			name:    "service accounts of another namespace",
+			subject: rbacv1.Subject{Kind: rbacv1.GroupKind, APIGroup: rbacv1.GroupName, Name: "system:serviceaccounts:other"},
+			want:    false,
+		},
+		{
+			name:    "all service accounts",
+			subject: rbacv1.Subject{Kind: rbacv1.GroupKind, APIGroup: rbacv1.GroupName, Name: "system:serviceaccounts"},
+			want:    true,
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := isBindingSubject([]rbacv1.Subject{tt.subject}, tt.bindingNamespace, sa); got != tt.want {
+				t.Errorf("isBindingSubject() = %t, want %t", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestPrivilegedRule(t *testing.T) {
+	tests := []struct {
+		name string
+		rule rbacv1.PolicyRule
+		// want is a substring of the finding, empty when the rule is not privileged
+		want string
+	}{
+		{
+			name: "read pods",
+			rule: rbacv1.PolicyRule{APIGroups: []string{""}, Resources: []string{"pods"}, Verbs: []string{"get", "list"}},
+		},
+		{
+			name: "all resources",
+			rule: rbacv1.PolicyRule{APIGroups: []string{""}, Resources: []string{"*"}, Verbs: []string{"get"}},
+			want: "all resources",
+		},
+		{
+			name: "all verbs",
+			rule: rbacv1.PolicyRule{APIGroups: []string{""}, Resources: []string{"configmaps"}, Verbs: []string{"*"}},
+			want: "[*] on [configmaps]",
+		},
+		{
+			name: "impersonate",
+			rule: rbacv1.PolicyRule{APIGroups: []string{""}, Resources: []string{"users"}, Verbs: []string{"impersonate"}},
+			want: "[impersonate] on [users]",
+		},
+		{
+			name: "read in all API groups",
+			rule: rbacv1.PolicyRule{APIGroups: []string{"*"}, Resources: []string{"configmaps"}, Verbs: []string{"get"}},
+		},
+		{
+			name: "write in all API groups",
+			rule: rbacv1.PolicyRule{APIGroups: []string{"*"}, Resources: []string{"configmaps"}, Verbs: []string{"get", "patch"}},
+			want: "[patch] on [configmaps] of all API groups",
+		},
+		{
+			name: "read secrets",
+			rule: rbacv1.PolicyRule{APIGroups: []string{""}, Resources: []string{"secrets"}, Verbs: []string{"list"}},
+			want: "[list] on [secrets]",
+		},
+		{
+			name: "read secrets of another API group",
+			rule: rbacv1.PolicyRule{APIGroups: []string{"example.com"}, Resources: []string{"secrets"}, Verbs: []string{"list"}},
+		},
+		{
+			name: "create tokens",
+			rule: rbacv1.PolicyRule{APIGroups: []string{""}, Resources: []string{"serviceaccounts/token"}, Verbs: []string{"create"}},
+			want: "[create] on [serviceaccounts/token]",
+		},
+		{
+			name: "write role bindings",
+			rule: rbacv1.PolicyRule{APIGroups: []string{rbacv1.GroupName}, Resources: []string{"rolebindings"}, Verbs: []string{"update"}},
+			want: "[update] on [rolebindings]",
+		},
+		{
+			name: "create pods",
+			rule: rbacv1.PolicyRule{APIGroups: []string{""}, Resources: []string{"pods"}, Verbs: []string{"create"}},
+			want: "[create] on [pods]",
+		},
+		{
+			name: "create deployments",
+			rule: rbacv1.PolicyRule{APIGroups: []string{"apps"}, Resources: []string{"deployments"}, Verbs: []string{"create"}},
+			want: "[create] on [deployments]",
+		},
+		{
+			name: "create cron jobs",
+			rule: rbacv1.PolicyRule{APIGroups: []string{"batch"}, Resources: []string{"cronjobs"}, Verbs: []string{"create"}},
+			want: "[create] on [cronjobs]",
+		},
+		{
+			name: "create deployments of another API group",
+			rule: rbacv1.PolicyRule{APIGroups: []string{"example.com"}, Resources: []string{"deployments"}, Verbs: []string{"create"}},
+		},
+		{
+			name: "non-resource URLs",
+			rule: rbacv1.PolicyRule{NonResourceURLs: []string{"*"}, Verbs: []string{"*"}},
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got := privilegedRule(tt.rule)
+			switch {
+			case tt.want == "" && got != "":
+				t.Errorf("privilegedRule() = %q, want no finding", got)
+			case tt.want != "" && !strings.Contains(got, tt.want):
+				t.Errorf("privilegedRule() = %q, want a finding containing %q", got, tt.want)
+			}
+		})
+	}
+}
@@ -0,0 +1,96 @@
+package controller
+
+import (
+	"cmp"
+	"fmt"
+	"slices"
+
+	corev1 "k8s.io/api/core/v1"
+)
+
+// managementMode is only known through the registry, a new mode is added by registering it.
+type managementMode struct {
+	name string
+	// order decides the mode of a service account enabling several, the lowest wins.
+	order      int
+	annotation string
+	// additional modes are managed alongside the mode of a service account.
+	additional  bool
+	permissions []permission
+	// validate may be nil.
+	validate   func(annotations map[string]string) error
+	newHandler func(r *ServiceAccountReconciler, sa *corev1.ServiceAccount, primary bool) (Handler, error)
+}
+
+func (m *managementMode) enabled(annotations map[string]string) bool {
+	_, ok := annotations[m.annotation]
+	return ok
+}
+
+// modes are sorted by order.
+var modes []*managementMode
+
+// registerMode is called from the init function of each mode.
+func registerMode(m *managementMode) {
+	if lookupMode(m.name) != nil {
+		panic(fmt.Sprintf("mode %q is already registered", m.name))
+	}
+
+	modes = append(modes, m)
+	slices.SortStableFunc(modes, func(a, b *managementMode) int { return cmp.Compare(a.order, b.order) })
+}
+
+func lookupMode(name string) *managementMode {
+	for _, m := range modes {
+		if m.name == name {
+			return m
+		}
+	}
+
+	return nil
+}
+
+// enabledModes returns the additional modes enabled on the service account, then mode.
+func enabledModes(annotations map[string]string, mode string) []*managementMode {
+	var enabled []*managementMode
+	for _, m := range modes {
+		if m.additional && m.name != mode && m.enabled(annotations) {
+			enabled = append(enabled, m)
+		}
+	}
+
+	if m := lookupMode(mode); m != nil {
+		enabled = append(enabled, m)
+	}
+
+	return enabled
+}
+
+func (r *ServiceAccountReconciler) getHandler(sa *corev1.ServiceAccount, mode string) (Handler, error) {
+	enabled := enabledModes(sa.Annotations, mode)
+	if len(enabled) == 0 || enabled[len(enabled)-1].name != mode {
+		return nil, fmt.Errorf("no handler found for service account %s/%s, this might mean that the annotation is not set correctly", sa.Namespace, sa.Name)
+	}
+
+	var hs handlers
+	for i, m := range enabled {
+		if m.validate != nil {
+			if err := m.validate(sa.Annotations); err != nil {
+				return nil, err
+			}
+		}
+
+		// the handler of the mode runs last, it marks a requested rotation as handled
+		h, err := m.newHandler(r, sa, i == len(enabled)-1)
+		if err != nil {
+			return nil, err
+		}
+		hs = append(hs, wrap(m.name, h, r.middlewares()...))
+	}
+
+	if len(hs) == 1 {
+		return hs[0], nil
+	}
+
+	return hs, nil
+}
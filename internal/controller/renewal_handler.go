@@ -5,39 +5,87 @@ import (
 	"fmt"
 	"time"
 
-	"github.com/go-logr/logr"
 	authenticationv1 "k8s.io/api/authentication/v1"
 	corev1 "k8s.io/api/core/v1"
-	apierrors "k8s.io/apimachinery/pkg/api/errors"
 	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/client-go/tools/record"
+	"k8s.io/utils/clock"
 	"k8s.io/utils/ptr"
 	ctrl "sigs.k8s.io/controller-runtime"
 	"sigs.k8s.io/controller-runtime/pkg/client"
 )
 
 type RenewalHandler struct {
-	Sa  *corev1.ServiceAccount
-	Ctx context.Context
 	client.Client
-	Log          logr.Logger
+	// APIReader defaults to the client.
+	APIReader    client.Reader
+	Recorder     record.EventRecorder
 	RenewalAfter time.Duration
+	DryRun       bool
+	AdoptLegacy  bool
+	SecretType   corev1.SecretType
+	ClusterCA    []byte
+	// Clock defaults to the real clock.
+	Clock clock.PassiveClock
 }
 
-func (h *RenewalHandler) needsRenewal() (bool, error) {
-	val, ok := h.Sa.Annotations["or.io/token-expiration"]
+var renewalMode = &managementMode{
+	name:       ModeRenewal,
+	order:      20,
+	annotation: "or.io/renew-after",
+	permissions: []permission{
+		{resource: "serviceaccounts", subresource: "token", verb: "create"},
+		{resource: "secrets", verb: "create"},
+		{resource: "secrets", verb: "patch"},
+		{resource: "secrets", verb: "delete"},
+	},
+	validate: func(annotations map[string]string) error {
+		_, err := getRenewalPeriod(annotations)
+		return err
+	},
+	newHandler: func(r *ServiceAccountReconciler, sa *corev1.ServiceAccount, _ bool) (Handler, error) {
+		renewalPeriod, err := getRenewalPeriod(sa.Annotations)
+		if err != nil {
+			return nil, err
+		}
+		return &RenewalHandler{Client: r.Client, APIReader: r.APIReader, Recorder: r.Recorder, RenewalAfter: renewalPeriod, DryRun: r.DryRun, AdoptLegacy: r.AdoptLegacySecrets,
+			SecretType: r.RenewalSecretType, ClusterCA: r.ClusterCA, Clock: r.Clock}, nil
+	},
+}
+
+func init() {
+	registerMode(renewalMode)
+}
+
+func (h *RenewalHandler) secretType() corev1.SecretType {
+	if h.SecretType == "" {
+		return DefaultRenewalSecretType
+	}
+	return h.SecretType
+}
+
+func (h *RenewalHandler) needsRenewal(now time.Time, sa *corev1.ServiceAccount) bool {
+	if rotationRequested(sa.Annotations) {
+		return true
+	}
+
+	// a missing or corrupted expiration is repaired by renewing the token, which rewrites it
+	expiration, ok := tokenExpiration(sa.Annotations)
 	if !ok {
-		return true, nil
+		return true
 	}
 
-	expiration, err := time.Parse(time.RFC3339, val)
-	if err != nil {
-		return false, err
+	// the current token outlives the renewal period, e.g. because it was shortened or capped by the policy
+	if outlives(now, expiration, h.RenewalAfter) {
+		return true
 	}
 
-	return time.Until(expiration) < time.Minute*30, nil
+	return expiration.Sub(now) < renewalThreshold(h.RenewalAfter)
 }
 
-func (h *RenewalHandler) renewToken() error {
+func (h *RenewalHandler) renewToken(ctx context.Context, sa *corev1.ServiceAccount, existing *corev1.Secret) (time.Time, error) {
+	log := ctrl.LoggerFrom(ctx)
+
 	tokenReq := &authenticationv1.TokenRequest{
 		Spec: authenticationv1.TokenRequestSpec{
 			Audiences:         []string{"https://kubernetes.default.svc"},
@@ -45,87 +93,164 @@ func (h *RenewalHandler) renewToken() error {
 		},
 	}
 
-	if err := h.SubResource("token").Create(h.Ctx, h.Sa, tokenReq); err != nil {
-		return err
+	// in dry-run mode no token is issued, the secret is written (server-side dry-run) without it
+	if h.DryRun {
+		recordAction(h.Recorder, log, sa, actionIssueToken, true, fmt.Sprintf("token valid for %s", h.RenewalAfter))
+	} else {
+		err := h.SubResource("token").Create(ctx, sa, tokenReq)
+		tokenRequests.record(err)
+		if err != nil {
+			// a missing or unreadable expiration is reported as no valid token
+			expiration, _ := tokenExpiration(sa.Annotations)
+			return time.Time{}, &renewalError{err: err, expiration: expiration, lifetime: h.RenewalAfter}
+		}
+		recordAction(h.Recorder, log, sa, actionIssueToken, false, fmt.Sprintf("token valid for %s", h.RenewalAfter))
 	}
 
-	ownerRef := *metav1.NewControllerRef(h.Sa, corev1.SchemeGroupVersion.WithKind("ServiceAccount"))
-	*ownerRef.BlockOwnerDeletion = false
-
 	secret := &corev1.Secret{
 		ObjectMeta: ctrl.ObjectMeta{
-			Name:            fmt.Sprintf("%s-token", h.Sa.Name),
-			Namespace:       h.Sa.Namespace,
-			OwnerReferences: []metav1.OwnerReference{ownerRef},
+			Name:            TokenSecretName(sa.Name),
+			Namespace:       sa.Namespace,
+			Labels:          managedSecretLabels(),
+			OwnerReferences: []metav1.OwnerReference{tokenSecretOwnerRef(sa)},
 			Annotations: map[string]string{
-				"kubernetes.io/service-account.name": h.Sa.Name,
+				"kubernetes.io/service-account.name": sa.Name,
+				secretModeAnnotation:                 ModeRenewal,
 			},
 		},
+		// same layout as the secrets populated by the token controller
 		Data: map[string][]byte{
-			"token": []byte(tokenReq.Status.Token),
+			"token":     []byte(tokenReq.Status.Token),
+			"namespace": []byte(sa.Namespace),
 		},
-		Type: corev1.SecretTypeServiceAccountToken,
+		Type: h.secretType(),
+	}
+	if len(h.ClusterCA) > 0 {
+		secret.Data["ca.crt"] = h.ClusterCA
 	}
 
-	err := h.Update(h.Ctx, secret)
-	if apierrors.IsNotFound(err) {
-		return h.Create(h.Ctx, secret)
+	var err error
+	switch {
+	case existing == nil:
+		err = applySecret(ctx, h.Client, secret, h.DryRun)
+	case isLegacySecret(existing, sa):
+		log.Info("migrating service account from long-lived to renewal mode, replacing legacy secret")
+		err = h.replaceSecret(ctx, sa, existing, secret, fmt.Sprintf("legacy long-lived secret %s", existing.Name))
+	case existing.Type != secret.Type:
+		// the type of a secret is immutable
+		log.Info("changing type of token secret, replacing it", "from", existing.Type, "to", secret.Type)
+		err = h.replaceSecret(ctx, sa, existing, secret, fmt.Sprintf("secret %s of type %s", existing.Name, existing.Type))
+	default:
+		if err = upgradeManagedFields(ctx, h.Client, existing.DeepCopy(), h.DryRun); err == nil {
+			err = applySecret(ctx, h.Client, secret, h.DryRun)
+		}
 	}
+	if err != nil {
+		return time.Time{}, err
+	}
+
+	recordAction(h.Recorder, log, sa, actionWriteSecret, h.DryRun, fmt.Sprintf("secret %s", secret.Name))
 
-	return err
+	return issuedExpiration(tokenReq, clockOrReal(h.Clock).Now()), nil
 }
 
-func (h *RenewalHandler) updateServiceAccountAnnotation() error {
-	h.Sa.Annotations["or.io/last-renewal"] = time.Now().UTC().Format(time.RFC3339)
-	h.Sa.Annotations["or.io/token-expiration"] = time.Now().UTC().Add(h.RenewalAfter).Format(time.RFC3339)
+// replaceSecret is called once the renewed token was issued, so a failing TokenRequest leaves the
+// existing secret untouched.
+func (h *RenewalHandler) replaceSecret(ctx context.Context, sa *corev1.ServiceAccount, existing *corev1.Secret, secret *corev1.Secret, description string) error {
+	if ownership := classifySecret(existing, sa); ownership != secretOwned && ownership != secretStale {
+		return fmt.Errorf("refusing to replace secret %s/%s with a renewed token, it is not owned by the service account", existing.Namespace, existing.Name)
+	}
 
-	return h.Update(h.Ctx, h.Sa)
-}
+	log := ctrl.LoggerFrom(ctx)
 
-func (h *RenewalHandler) calculateRequeuePeriod() (time.Duration, error) {
-	val, ok := h.Sa.Annotations["or.io/token-expiration"]
-	if !ok {
-		return 0, fmt.Errorf("service account %s does not have last-renewal annotation", h.Sa.Name)
+	deleteOpts := append(deleteOptions(h.DryRun), client.Preconditions{UID: &existing.UID})
+	if err := h.Delete(ctx, existing, deleteOpts...); client.IgnoreNotFound(err) != nil {
+		return err
 	}
+	recordAction(h.Recorder, log, sa, actionDeleteSecret, h.DryRun, description)
 
-	expiration, err := time.Parse(time.RFC3339, val)
-	if err != nil {
-		return 0, err
+	// in dry-run mode the existing secret was never deleted, applying the new one would only fail
+	if h.DryRun {
+		return nil
 	}
 
-	return time.Until(expiration) - time.Minute*5, nil
+	return applySecret(ctx, h.Client, secret, h.DryRun)
 }
 
-func (h *RenewalHandler) Handle() (ctrl.Result, error) {
-	needsRewnwal, err := h.needsRenewal()
-	if err != nil {
-		h.Log.Error(err, "failed to determine if service account needs renewal", "name", h.Sa.Name, "namespace", h.Sa.Namespace)
-		return ctrl.Result{}, err
+func (h *RenewalHandler) updateServiceAccountAnnotation(ctx context.Context, sa *corev1.ServiceAccount, expiration time.Time) error {
+	sa.Annotations["or.io/last-renewal"] = clockOrReal(h.Clock).Now().UTC().Format(time.RFC3339)
+	sa.Annotations["or.io/token-expiration"] = expiration.UTC().Format(time.RFC3339)
+	markRotationHandled(sa.Annotations)
+
+	if err := applyServiceAccountAnnotations(ctx, h.Client, sa, h.DryRun); err != nil {
+		return err
 	}
 
-	if needsRewnwal {
-		h.Log.Info("service account token needs renewal, updating last-renewal annotation", "name", h.Sa.Name, "namespace", h.Sa.Namespace)
+	recordAction(h.Recorder, ctrl.LoggerFrom(ctx), sa, actionUpdateAnnotations, h.DryRun, "renewal annotations")
 
-		if err := h.renewToken(); err != nil {
-			h.Log.Error(err, "failed to renew token for service account", "name", h.Sa.Name, "namespace", h.Sa.Namespace)
-			return ctrl.Result{}, err
+	return nil
+}
+
+func (h *RenewalHandler) Handle(ctx context.Context, sa *corev1.ServiceAccount) (ctrl.Result, error) {
+	log := ctrl.LoggerFrom(ctx)
+
+	clk := clockOrReal(h.Clock)
+	needsRenewal := h.needsRenewal(clk.Now(), sa)
+
+	if val, ok := sa.Annotations["or.io/token-expiration"]; ok {
+		expiration, valid := tokenExpiration(sa.Annotations)
+		switch {
+		case !valid:
+			log.Info("token expiration annotation of service account is corrupted, renewing the token to repair it", "expiration", val)
+			recordWarning(h.Recorder, sa, "CorruptedAnnotation", fmt.Sprintf("unreadable token expiration %q, renewing the token", val))
+		case clk.Now().After(expiration):
+			log.Info("token of service account expired, renewing it immediately", "expiration", val)
 		}
+	}
+
+	existing, err := getTokenSecret(ctx, readerOrClient(h.APIReader, h.Client), sa)
+	if err != nil {
+		return ctrl.Result{}, fmt.Errorf("failed to get secret of service account: %w", err)
+	}
 
-		if err := h.updateServiceAccountAnnotation(); err != nil {
-			h.Log.Error(err, "failed to update service account annotation", "name", h.Sa.Name, "namespace", h.Sa.Namespace)
+	if existing != nil {
+		claim := &secretClaim{Client: h.Client, Recorder: h.Recorder, AdoptLegacy: h.AdoptLegacy, DryRun: h.DryRun}
+		if err := claim.claim(ctx, sa, existing); err != nil {
 			return ctrl.Result{}, err
 		}
 
-		h.Log.Info("successfully renewed token for service account", "name", h.Sa.Name, "namespace", h.Sa.Namespace)
+		// replace secrets that may hold a non-expiring or foreign token right away
+		if isLegacySecret(existing, sa) || existing.Type != h.secretType() {
+			needsRenewal = true
+		}
+
+		if classifySecret(existing, sa) == secretStale {
+			log.Info("secret was written for a previous service account with the same name, reissuing the token")
+			recordWarning(h.Recorder, sa, "StaleSecret", fmt.Sprintf("secret %s was written for a previous service account with the same name, reissuing the token", existing.Name))
+			needsRenewal = true
+		}
 	}
 
-	requeuePeriod, err := h.calculateRequeuePeriod()
-	if err != nil {
-		h.Log.Error(err, "failed to calculate requeue period for service account", "name", h.Sa.Name, "namespace", h.Sa.Namespace)
-		return ctrl.Result{}, err
+	if needsRenewal {
+		log.Info("service account token needs renewal, updating last-renewal annotation")
+
+		expiration, err := h.renewToken(ctx, sa, existing)
+		if err != nil {
+			return ctrl.Result{}, fmt.Errorf("failed to renew token for service account: %w", err)
+		}
+
+		if err := h.updateServiceAccountAnnotation(ctx, sa, expiration); err != nil {
+			return ctrl.Result{}, fmt.Errorf("failed to update service account annotation: %w", err)
+		}
+
+		log.Info("successfully renewed token for service account")
 	}
 
-	h.Log.Info("requeuing reconciliation for service account", "name", h.Sa.Name, "namespace", h.Sa.Namespace, "after", requeuePeriod.String())
+	// renewed above when missing or corrupted
+	expiration, _ := tokenExpiration(sa.Annotations)
+	after := requeuePeriod(clk.Now(), expiration, h.RenewalAfter)
+
+	log.Info("requeuing reconciliation for service account", "after", after.String())
 
-	return ctrl.Result{RequeueAfter: requeuePeriod}, nil
+	return ctrl.Result{RequeueAfter: after}, nil
 }
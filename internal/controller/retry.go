@@ -0,0 +1,122 @@
+package controller
+
+import (
+	"context"
+	"fmt"
+	"sync"
+	"time"
+
+	"github.com/go-logr/logr"
+	corev1 "k8s.io/api/core/v1"
+	apierrors "k8s.io/apimachinery/pkg/api/errors"
+	"k8s.io/apimachinery/pkg/types"
+	ctrl "sigs.k8s.io/controller-runtime"
+	"sigs.k8s.io/controller-runtime/pkg/reconcile"
+)
+
+const (
+	minRetryDelay = 10 * time.Second
+	maxRetryDelay = 10 * time.Minute
+)
+
+type renewalError struct {
+	err error
+	// expiration of the current token, zero when unknown.
+	expiration time.Time
+	lifetime   time.Duration
+}
+
+func (e *renewalError) Error() string {
+	return fmt.Sprintf("failed to issue token: %v", e.err)
+}
+
+func (e *renewalError) Unwrap() error {
+	return e.err
+}
+
+func (e *renewalError) terminal() bool {
+	return apierrors.IsForbidden(e.err) || apierrors.IsNotFound(e.err) || apierrors.IsBadRequest(e.err) || apierrors.IsInvalid(e.err)
+}
+
+// retryDelay retries at least three times before the current token expires.
+func retryDelay(failures int, remaining time.Duration) time.Duration {
+	delay := maxRetryDelay
+	if failures < 16 {
+		delay = min(delay, minRetryDelay<<(failures-1))
+	}
+
+	if remaining > 0 {
+		delay = min(delay, remaining/3)
+	}
+
+	return max(delay, minRetryDelay)
+}
+
+// failureTracker is lost on restart, it only drives the backoff.
+type failureTracker struct {
+	mu       sync.Mutex
+	failures map[types.NamespacedName]int
+}
+
+func (t *failureTracker) inc(key types.NamespacedName) int {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	if t.failures == nil {
+		t.failures = map[types.NamespacedName]int{}
+	}
+	t.failures[key]++
+
+	return t.failures[key]
+}
+
+func (t *failureTracker) reset(key types.NamespacedName) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	delete(t.failures, key)
+}
+
+// handleRenewalFailure retries terminal errors only when the service account changes or the cache resyncs.
+func (r *ServiceAccountReconciler) handleRenewalFailure(ctx context.Context, sa *corev1.ServiceAccount, renewal *renewalError, log logr.Logger) (ctrl.Result, error) {
+	key := types.NamespacedName{Namespace: sa.Namespace, Name: sa.Name}
+
+	if renewal.terminal() {
+		r.failures.reset(key)
+		message := fmt.Sprintf("renewing the token failed, not retrying until the service account changes or the cache resyncs: %v", renewal.err)
+		log.Info("token renewal failed permanently", "name", sa.Name, "namespace", sa.Namespace, "error", renewal.err.Error())
+		renewalFailuresTotal.WithLabelValues("terminal").Inc()
+		recordWarning(r.Recorder, sa, "RenewalFailed", message)
+
+		if err := r.setStatus(ctx, sa, fmt.Sprintf("Failed: %v", renewal.err)); err != nil {
+			return ctrl.Result{}, err
+		}
+		return ctrl.Result{}, reconcile.TerminalError(renewal)
+	}
+
+	remaining := renewal.expiration.Sub(clockOrReal(r.Clock).Now())
+	failures := r.failures.inc(key)
+	delay := retryDelay(failures, remaining)
+
+	var state, reason, message, status string
+	switch {
+	case renewal.expiration.IsZero() || remaining <= 0:
+		state, reason = "expired", "TokenExpired"
+		message = fmt.Sprintf("no valid token, issuing one failed %d times, retrying in %s: %v", failures, delay, renewal.err)
+		status = fmt.Sprintf("TokenExpired: %v", renewal.err)
+	case remaining < renewalThreshold(renewal.lifetime)/2:
+		state, reason = "expiring", "TokenExpiringSoon"
+		message = fmt.Sprintf("token expires in %s, renewing it failed %d times, retrying in %s: %v", remaining.Round(time.Second), failures, delay, renewal.err)
+		status = fmt.Sprintf("RenewalFailing: %v", renewal.err)
+	default:
+		state, reason = "failing", "RenewalFailed"
+		message = fmt.Sprintf("renewing the token failed %d times, it is still valid for %s, retrying in %s: %v", failures, remaining.Round(time.Second), delay, renewal.err)
+		status = fmt.Sprintf("RenewalFailing: %v", renewal.err)
+	}
+
+	log.Info("token renewal failed, retrying", "name", sa.Name, "namespace", sa.Namespace, "failures", failures, "after", delay.String(), "error", renewal.err.Error())
+	renewalFailuresTotal.WithLabelValues(state).Inc()
+	recordWarning(r.Recorder, sa, reason, message)
+
+	return ctrl.Result{RequeueAfter: delay}, r.setStatus(ctx, sa, status)
+}
@@ -2,63 +2,274 @@ package controller
 
 import (
 	"context"
+	"errors"
 	"fmt"
+	"slices"
 	"time"
 
 	"github.com/go-logr/logr"
+	authenticationv1 "k8s.io/api/authentication/v1"
 	corev1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/types"
+	"k8s.io/utils/ptr"
 	ctrl "sigs.k8s.io/controller-runtime"
 	"sigs.k8s.io/controller-runtime/pkg/client"
 )
 
+const secretModeAnnotation = "or.io/mode"
+
+// isLegacySecret reports a secret holding a non-expiring token.
+func isLegacySecret(secret *corev1.Secret, sa *corev1.ServiceAccount) bool {
+	switch secret.Annotations[secretModeAnnotation] {
+	case ModeRenewal:
+		return false
+	case ModeLongLived:
+		return true
+	}
+
+	// secrets written before the mode was recorded on them, renewal mode always sets the last-renewal annotation
+	_, renewed := sa.Annotations["or.io/last-renewal"]
+	return !renewed
+}
+
 func hasLongLivedAnnotation(annotations map[string]string) bool {
-	_, ok := annotations["or.io/create-secret"]
-	return ok
+	return longLivedMode.enabled(annotations)
 }
 
 func hasRenewalAnnotation(annotations map[string]string) bool {
-	_, ok := annotations["or.io/renew-after"]
-	return ok
+	return renewalMode.enabled(annotations)
 }
 
+func rotationRequested(annotations map[string]string) bool {
+	val, ok := annotations[RotateAnnotation]
+	return ok && val != annotations["or.io/rotation-handled"]
+}
+
+func markRotationHandled(annotations map[string]string) {
+	if val, ok := annotations[RotateAnnotation]; ok {
+		annotations["or.io/rotation-handled"] = val
+	}
+}
+
+const minTokenRequestLifetime = 10 * time.Minute
+
+// getRenewalPeriod leaves the minimum to the policy.
 func getRenewalPeriod(annotations map[string]string) (time.Duration, error) {
 	dur, err := time.ParseDuration(annotations["or.io/renew-after"])
 	if err != nil {
 		return 0, err
 	}
 
-	if dur < time.Hour*24 {
-		return 0, fmt.Errorf("renewal period must be at least 24h, got %s", dur.String())
+	if dur < minTokenRequestLifetime {
+		return 0, fmt.Errorf("renewal period must be at least %s, got %s", minTokenRequestLifetime, dur.String())
 	}
 
 	return dur, nil
 
 }
 
-func getHandler(sa *corev1.ServiceAccount, ctx context.Context, runtimeClient client.Client, log logr.Logger) (Handler, error) {
-	annotations := sa.Annotations
+// minRequeuePeriod avoids a tight loop when a token expires right away.
+const minRequeuePeriod = 30 * time.Second
 
-	if hasLongLivedAnnotation(annotations) {
-		return &LongLivedHandler{Sa: sa, Ctx: ctx, Log: log, Client: runtimeClient}, nil
+func tokenExpiration(annotations map[string]string) (time.Time, bool) {
+	expiration, err := time.Parse(time.RFC3339, annotations["or.io/token-expiration"])
+	return expiration, err == nil
+}
+
+// issuedExpiration may be sooner than requested (--service-account-max-token-expiration).
+func issuedExpiration(tokenReq *authenticationv1.TokenRequest, now time.Time) time.Time {
+	if tokenReq.Status.ExpirationTimestamp.IsZero() {
+		return now.Add(time.Duration(ptr.Deref(tokenReq.Spec.ExpirationSeconds, 0)) * time.Second)
 	}
+	return tokenReq.Status.ExpirationTimestamp.Time
+}
+
+// outlives allows for clock skew with the API server.
+func outlives(now time.Time, expiration time.Time, lifetime time.Duration) bool {
+	return expiration.Sub(now) > lifetime+time.Minute
+}
 
-	if hasRenewalAnnotation(annotations) {
-		renewalPeriod, err := getRenewalPeriod(annotations)
+func requeuePeriod(now time.Time, expiration time.Time, lifetime time.Duration) time.Duration {
+	return max(minRequeuePeriod, expiration.Sub(now)-requeueMargin(lifetime))
+}
+
+func renewalThreshold(lifetime time.Duration) time.Duration {
+	return min(time.Minute*30, lifetime/5)
+}
+
+// requeueMargin is shorter than the renewal threshold, so the check always renews the token.
+func requeueMargin(lifetime time.Duration) time.Duration {
+	return min(time.Minute*5, lifetime/10)
+}
+
+// handlers stop at the first error and requeue at the earliest.
+type handlers []Handler
+
+func (hs handlers) Handle(ctx context.Context, sa *corev1.ServiceAccount) (ctrl.Result, error) {
+	var result ctrl.Result
+	for _, h := range hs {
+		res, err := h.Handle(ctx, sa)
 		if err != nil {
-			return nil, err
+			return res, err
+		}
+
+		if res.RequeueAfter > 0 && (result.RequeueAfter == 0 || res.RequeueAfter < result.RequeueAfter) {
+			result.RequeueAfter = res.RequeueAfter
+		}
+	}
+
+	return result, nil
+}
+
+// findHandler returns the handler of type T, looking into combined and wrapped handlers.
+func findHandler[T Handler](handler Handler) (T, bool) {
+	if hs, ok := handler.(handlers); ok {
+		for _, h := range hs {
+			if found, ok := findHandler[T](h); ok {
+				return found, true
+			}
 		}
-		return &RenewalHandler{Sa: sa, Ctx: ctx, Log: log, Client: runtimeClient, RenewalAfter: renewalPeriod}, nil
 	}
 
-	return nil, fmt.Errorf("no handler found for service account %s/%s, this might mean that the annotation is not set correctly", sa.Namespace, sa.Name)
+	if w, ok := handler.(interface{ Unwrap() Handler }); ok {
+		return findHandler[T](w.Unwrap())
+	}
+
+	found, ok := handler.(T)
+	return found, ok
 }
 
+func (r *ServiceAccountReconciler) handle(ctx context.Context, sa *corev1.ServiceAccount, handler Handler, log logr.Logger) (ctrl.Result, error) {
+	result, err := handler.Handle(ctx, sa)
+
+	var blocked *blockedError
+	if errors.As(err, &blocked) {
+		log.Info("refusing to manage service account", "name", sa.Name, "namespace", sa.Namespace, "reason", blocked.message)
+		recordWarning(r.Recorder, sa, blocked.reason, blocked.message)
+		return result, r.setStatus(ctx, sa, fmt.Sprintf("Blocked: %s", blocked.message))
+	}
+
+	var renewal *renewalError
+	if errors.As(err, &renewal) {
+		return r.handleRenewalFailure(ctx, sa, renewal, log)
+	}
+
+	if err != nil {
+		return result, err
+	}
+
+	r.failures.reset(types.NamespacedName{Namespace: sa.Namespace, Name: sa.Name})
+
+	return result, r.setStatus(ctx, sa, "")
+}
+
+func readerOrClient(reader client.Reader, c client.Client) client.Reader {
+	if reader == nil {
+		return c
+	}
+	return reader
+}
+
+// fetchInstance returns nil when the service account does not exist or is not managed.
 func (r *ServiceAccountReconciler) fetchInstance(ctx context.Context, req ctrl.Request) (*corev1.ServiceAccount, error) {
-	sa := &corev1.ServiceAccount{}
+	meta := &metav1.PartialObjectMetadata{}
+	meta.SetGroupVersionKind(corev1.SchemeGroupVersion.WithKind("ServiceAccount"))
+
+	if err := r.Get(ctx, req.NamespacedName, meta); err != nil {
+		return nil, client.IgnoreNotFound(err)
+	}
+
+	if ManagementMode(meta.Annotations) == "" {
+		return nil, nil
+	}
 
-	if err := r.Get(ctx, req.NamespacedName, sa); err != nil {
+	sa := &corev1.ServiceAccount{}
+	if err := readerOrClient(r.APIReader, r.Client).Get(ctx, req.NamespacedName, sa); err != nil {
 		return nil, client.IgnoreNotFound(err)
 	}
 
 	return sa, nil
 }
+
+// enforcePolicy applies a lifetime cap of the policy to the handler.
+func (r *ServiceAccountReconciler) enforcePolicy(ctx context.Context, sa *corev1.ServiceAccount, mode string, handler Handler, log logr.Logger) (bool, error) {
+	renewalHandler, _ := findHandler[*RenewalHandler](handler)
+	namedHandler, _ := findHandler[*NamedTokensHandler](handler)
+
+	var modes []string
+	var renewalPeriods []time.Duration
+	switch {
+	case renewalHandler != nil:
+		modes = append(modes, ModeRenewal)
+		renewalPeriods = append(renewalPeriods, renewalHandler.RenewalAfter)
+	case mode != ModeNamedTokens:
+		modes = append(modes, mode)
+	}
+	// named tokens expire like renewal mode tokens, each of them is checked as such
+	if namedHandler != nil {
+		if !slices.Contains(modes, ModeRenewal) {
+			modes = append(modes, ModeRenewal)
+		}
+		for _, spec := range namedHandler.Specs {
+			renewalPeriods = append(renewalPeriods, spec.Lifetime.Duration)
+		}
+	}
+
+	decision, err := evaluatePolicy(ctx, r.Client, r.Policy, sa, modes, renewalPeriods)
+	if err != nil {
+		return false, err
+	}
+
+	if decision.denial != "" {
+		log.Info("policy denies managing service account", "name", sa.Name, "namespace", sa.Namespace, "mode", mode, "reason", decision.denial)
+		policyDenialsTotal.WithLabelValues(mode).Inc()
+		recordWarning(r.Recorder, sa, "PolicyDenied", decision.denial)
+
+		return true, r.setStatus(ctx, sa, fmt.Sprintf("Denied: %s", decision.denial))
+	}
+
+	lifetimeCap, capReason := decision.lifetimeCap, decision.capReason
+	if lifetimeCap == 0 {
+		return false, nil
+	}
+
+	if renewalHandler != nil && renewalHandler.RenewalAfter > lifetimeCap {
+		message := fmt.Sprintf("token lifetime capped from %s to %s: %s", renewalHandler.RenewalAfter, lifetimeCap, capReason)
+		log.Info("policy caps token lifetime of service account", "name", sa.Name, "namespace", sa.Namespace, "reason", message)
+		recordWarning(r.Recorder, sa, "LifetimeCapped", message)
+		renewalHandler.RenewalAfter = lifetimeCap
+	}
+
+	if namedHandler != nil {
+		for i := range namedHandler.Specs {
+			spec := &namedHandler.Specs[i]
+			if spec.Lifetime.Duration <= lifetimeCap {
+				continue
+			}
+
+			message := fmt.Sprintf("lifetime of token %s capped from %s to %s: %s", spec.Name, spec.Lifetime.Duration, lifetimeCap, capReason)
+			log.Info("policy caps token lifetime of service account", "name", sa.Name, "namespace", sa.Namespace, "reason", message)
+			recordWarning(r.Recorder, sa, "LifetimeCapped", message)
+			spec.Lifetime.Duration = lifetimeCap
+		}
+	}
+
+	return false, nil
+}
+
+// setStatus must be called at most once per reconciliation, flipping the annotation would
+// trigger reconciliations endlessly.
+func (r *ServiceAccountReconciler) setStatus(ctx context.Context, sa *corev1.ServiceAccount, status string) error {
+	if sa.Annotations[StatusAnnotation] == status {
+		return nil
+	}
+
+	if status == "" {
+		delete(sa.Annotations, StatusAnnotation)
+	} else {
+		sa.Annotations[StatusAnnotation] = status
+	}
+
+	return applyServiceAccountAnnotations(ctx, r.Client, sa, r.DryRun)
+}
@@ -2,27 +2,62 @@ package controller
 
 import (
 	"context"
+	"time"
 
 	corev1 "k8s.io/api/core/v1"
 	"k8s.io/apimachinery/pkg/runtime"
+	"k8s.io/client-go/tools/record"
+	"k8s.io/utils/clock"
+	"k8s.io/utils/ptr"
 	ctrl "sigs.k8s.io/controller-runtime"
+	"sigs.k8s.io/controller-runtime/pkg/builder"
 	"sigs.k8s.io/controller-runtime/pkg/client"
-	"sigs.k8s.io/controller-runtime/pkg/event"
-	"sigs.k8s.io/controller-runtime/pkg/predicate"
+	"sigs.k8s.io/controller-runtime/pkg/controller"
+	"sigs.k8s.io/controller-runtime/pkg/handler"
 )
 
+// Handler manages the tokens of a service account in one mode.
 type Handler interface {
-	Handle() (ctrl.Result, error)
+	Handle(ctx context.Context, sa *corev1.ServiceAccount) (ctrl.Result, error)
 }
 
 type ServiceAccountReconciler struct {
 	client.Client
+	// APIReader reads what the cache does not hold, defaults to the client.
+	APIReader        client.Reader
 	Scheme           *runtime.Scheme
 	LongLivedHandler *LongLivedHandler
+	Recorder         record.EventRecorder
+	// DryRun sends writes as server-side dry-run requests and issues no tokens.
+	DryRun bool
+	// Policy allows everything when nil.
+	Policy *Policy
+	// ModeConflictPolicy defaults to prefer-long-lived.
+	ModeConflictPolicy string
+	AdoptLegacySecrets bool
+	// RenewalSecretType defaults to Opaque.
+	RenewalSecretType corev1.SecretType
+	ClusterCA         []byte
+	APIServerURL      string
+	// Permissions disables the modes the operator is missing permissions for, nil enables all modes.
+	Permissions *PermissionCheck
+	// HandlerTimeout bounds the time a handler spends on a service account, zero disables it.
+	HandlerTimeout time.Duration
+	// Middlewares are wrapped around every handler, inside the default ones.
+	Middlewares []Middleware
+	// Clock tells the time when renewing tokens, defaults to the real clock.
+	Clock clock.PassiveClock
+
+	failures failureTracker
 }
 
-// +kubebuilder:rbac:groups=core,resources=serviceaccounts,verbs=get;list;watch
-// +kubebuilder:rbac:groups="",resources=secrets,verbs=create
+// +kubebuilder:rbac:groups=core,resources=serviceaccounts,verbs=get;list;watch;patch
+// +kubebuilder:rbac:groups=core,resources=serviceaccounts/token,verbs=create
+// +kubebuilder:rbac:groups="",resources=secrets,verbs=get;list;watch;create;patch;delete
+// +kubebuilder:rbac:groups="",resources=events,verbs=create;patch
+// +kubebuilder:rbac:groups="",resources=namespaces,verbs=get;list;watch
+// +kubebuilder:rbac:groups=rbac.authorization.k8s.io,resources=clusterrolebindings;rolebindings,verbs=list;watch
+// +kubebuilder:rbac:groups=rbac.authorization.k8s.io,resources=clusterroles;roles,verbs=get;list;watch
 
 func (r *ServiceAccountReconciler) Reconcile(ctx context.Context, req ctrl.Request) (ctrl.Result, error) {
 	log := ctrl.LoggerFrom(ctx)
@@ -35,35 +70,74 @@ func (r *ServiceAccountReconciler) Reconcile(ctx context.Context, req ctrl.Reque
 		return ctrl.Result{}, err
 	}
 
+	if sa == nil {
+		log.Info("service account is gone or not managed anymore, skipping", "name", req.Name, "namespace", req.Namespace)
+		return ctrl.Result{}, nil
+	}
+
 	log.Info("fetched service account instance", "name", sa.Name, "namespace", sa.Namespace)
 
-	handler, err := getHandler(sa, ctx, r.Client, log)
+	mode, err := r.resolveMode(ctx, sa, log)
+	if err != nil {
+		log.Error(err, "failed to report mode conflict of service account", "name", sa.Name, "namespace", sa.Namespace)
+		return ctrl.Result{}, err
+	}
+
+	if mode == "" {
+		return ctrl.Result{}, nil
+	}
+
+	suspended, err := r.checkSuspended(ctx, sa, log)
+	if err != nil {
+		log.Error(err, "failed to report suspension of service account", "name", sa.Name, "namespace", sa.Namespace)
+		return ctrl.Result{}, err
+	}
+
+	if suspended {
+		return ctrl.Result{}, nil
+	}
+
+	disabled, err := r.checkPermissions(ctx, sa, mode, log)
+	if err != nil {
+		log.Error(err, "failed to report disabled mode of service account", "name", sa.Name, "namespace", sa.Namespace)
+		return ctrl.Result{}, err
+	}
+
+	if disabled {
+		return ctrl.Result{}, nil
+	}
+
+	handler, err := r.getHandler(sa, mode)
 	if err != nil {
 		log.Error(err, "failed to parse service account annotation", "name", sa.Name, "namespace", sa.Namespace)
 		return ctrl.Result{}, nil
 	}
 
-	return handler.Handle()
-}
+	denied, err := r.enforcePolicy(ctx, sa, mode, handler, log)
+	if err != nil {
+		log.Error(err, "failed to evaluate policy for service account", "name", sa.Name, "namespace", sa.Namespace)
+		return ctrl.Result{}, err
+	}
 
-func (r *ServiceAccountReconciler) SetupWithManager(mgr ctrl.Manager) error {
-	pred := predicate.Funcs{
-		CreateFunc: func(e event.CreateEvent) bool {
-			return hasLongLivedAnnotation(e.Object.GetAnnotations()) || hasRenewalAnnotation(e.Object.GetAnnotations())
-		},
-		UpdateFunc: func(e event.UpdateEvent) bool {
-			return hasLongLivedAnnotation(e.ObjectNew.GetAnnotations()) || hasRenewalAnnotation(e.ObjectNew.GetAnnotations())
-		},
-		DeleteFunc: func(e event.DeleteEvent) bool {
-			return false
-		},
-		GenericFunc: func(e event.GenericEvent) bool {
-			return hasLongLivedAnnotation(e.Object.GetAnnotations()) || hasRenewalAnnotation(e.Object.GetAnnotations())
-		},
+	if denied {
+		return ctrl.Result{}, nil
 	}
 
+	if err := r.cleanupNamedTokens(ctx, sa); err != nil {
+		log.Error(err, "failed to clean up secrets of removed named tokens", "name", sa.Name, "namespace", sa.Namespace)
+		return ctrl.Result{}, err
+	}
+
+	return r.handle(ctx, sa, handler, log)
+}
+
+func (r *ServiceAccountReconciler) SetupWithManager(mgr ctrl.Manager) error {
 	return ctrl.NewControllerManagedBy(mgr).
-		For(&corev1.ServiceAccount{}).
-		WithEventFilter(pred).
+		Named("serviceaccount").
+		Watches(&corev1.ServiceAccount{}, &enqueueByExpiry{clock: r.Clock, reader: r.Client}, builder.OnlyMetadata, builder.WithPredicates(serviceAccountPredicate())).
+		Watches(&corev1.Secret{},
+			handler.EnqueueRequestForOwner(mgr.GetScheme(), mgr.GetRESTMapper(), &corev1.ServiceAccount{}, handler.OnlyControllerOwner()),
+			builder.WithPredicates(ownedSecretPredicate())).
+		WithOptions(controller.Options{UsePriorityQueue: ptr.To(true)}).
 		Complete(r)
 }
@@ -0,0 +1,480 @@
+package controller
+
+import (
+	"errors"
+	"time"
+
+	"github.com/go-logr/logr"
+	. "github.com/onsi/ginkgo/v2"
+	. "github.com/onsi/gomega"
+	corev1 "k8s.io/api/core/v1"
+	rbacv1 "k8s.io/api/rbac/v1"
+	apierrors "k8s.io/apimachinery/pkg/api/errors"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/client-go/kubernetes/scheme"
+	"k8s.io/client-go/tools/record"
+	clocktesting "k8s.io/utils/clock/testing"
+	"k8s.io/utils/ptr"
+	ctrl "sigs.k8s.io/controller-runtime"
+	"sigs.k8s.io/controller-runtime/pkg/client"
+	"sigs.k8s.io/controller-runtime/pkg/envtest"
+	"sigs.k8s.io/controller-runtime/pkg/reconcile"
+)
+
+// The reconciler is called directly instead of running a manager, so each spec controls when
+// service accounts are reconciled and sees the result of every reconciliation.
+var _ = Describe("ServiceAccount Controller", func() {
+	var (
+		namespace  string
+		recorder   *record.FakeRecorder
+		reconciler *ServiceAccountReconciler
+	)
+
+	BeforeEach(func() {
+		ns := &corev1.Namespace{ObjectMeta: metav1.ObjectMeta{GenerateName: "sa-token-"}}
+		Expect(k8sClient.Create(ctx, ns)).To(Succeed())
+		namespace = ns.Name
+
+		recorder = record.NewFakeRecorder(100)
+		reconciler = &ServiceAccountReconciler{
+			Client:   k8sClient,
+			Scheme:   scheme.Scheme,
+			Recorder: recorder,
+		}
+	})
+
+	createServiceAccount := func(name string, annotations map[string]string) *corev1.ServiceAccount {
+		sa := &corev1.ServiceAccount{
+			ObjectMeta: metav1.ObjectMeta{Name: name, Namespace: namespace, Annotations: annotations},
+		}
+		Expect(k8sClient.Create(ctx, sa)).To(Succeed())
+		return sa
+	}
+
+	reconcileServiceAccount := func(sa *corev1.ServiceAccount) (ctrl.Result, error) {
+		return reconciler.Reconcile(ctx, ctrl.Request{NamespacedName: client.ObjectKeyFromObject(sa)})
+	}
+
+	getServiceAccount := func(sa *corev1.ServiceAccount) *corev1.ServiceAccount {
+		current := &corev1.ServiceAccount{}
+		Expect(k8sClient.Get(ctx, client.ObjectKeyFromObject(sa), current)).To(Succeed())
+		return current
+	}
+
+	getSecret := func(sa *corev1.ServiceAccount) *corev1.Secret {
+		secret := &corev1.Secret{}
+		Expect(k8sClient.Get(ctx, client.ObjectKey{Namespace: namespace, Name: TokenSecretName(sa.Name)}, secret)).To(Succeed())
+		return secret
+	}
+
+	expectNoSecret := func(sa *corev1.ServiceAccount) {
+		err := k8sClient.Get(ctx, client.ObjectKey{Namespace: namespace, Name: TokenSecretName(sa.Name)}, &corev1.Secret{})
+		Expect(apierrors.IsNotFound(err)).To(BeTrue(), "expected no token secret, got %v", err)
+	}
+
+	// expectEvent drains the recorded events until one with the reason shows up
+	expectEvent := func(reason string) {
+		Eventually(recorder.Events).Should(Receive(ContainSubstring(" " + reason + " ")))
+	}
+
+	expectOwnedBy := func(secret *corev1.Secret, sa *corev1.ServiceAccount) {
+		Expect(secret.Labels).To(HaveKeyWithValue(ManagedByLabel, ManagedByValue))
+		Expect(secret.OwnerReferences).To(ConsistOf(HaveField("UID", sa.UID)))
+	}
+
+	Context("in long-lived mode", func() {
+		annotations := func() map[string]string {
+			return map[string]string{"or.io/create-secret": "true"}
+		}
+
+		It("creates a token secret owned by the service account", func() {
+			sa := createServiceAccount("app", annotations())
+
+			result, err := reconcileServiceAccount(sa)
+			Expect(err).NotTo(HaveOccurred())
+			Expect(result).To(Equal(ctrl.Result{}))
+
+			secret := getSecret(sa)
+			Expect(secret.Type).To(Equal(corev1.SecretTypeServiceAccountToken))
+			Expect(secret.Annotations).To(HaveKeyWithValue("kubernetes.io/service-account.name", "app"))
+			expectOwnedBy(secret, sa)
+			Expect(getServiceAccount(sa).Annotations).NotTo(HaveKey(StatusAnnotation))
+		})
+
+		It("keeps the secret it already created", func() {
+			sa := createServiceAccount("app", annotations())
+
+			_, err := reconcileServiceAccount(sa)
+			Expect(err).NotTo(HaveOccurred())
+			created := getSecret(sa)
+
+			_, err = reconcileServiceAccount(sa)
+			Expect(err).NotTo(HaveOccurred())
+			Expect(getSecret(sa).UID).To(Equal(created.UID))
+		})
+
+		It("refuses to touch a secret it does not own", func() {
+			foreign := &corev1.Secret{
+				ObjectMeta: metav1.ObjectMeta{Name: TokenSecretName("app"), Namespace: namespace},
+				StringData: map[string]string{"password": "hunter2"},
+			}
+			Expect(k8sClient.Create(ctx, foreign)).To(Succeed())
+			sa := createServiceAccount("app", annotations())
+
+			_, err := reconcileServiceAccount(sa)
+			Expect(err).NotTo(HaveOccurred())
+
+			Expect(getServiceAccount(sa).Annotations[StatusAnnotation]).To(HavePrefix("Blocked:"))
+			expectEvent("ForeignSecret")
+
+			secret := getSecret(sa)
+			Expect(secret.UID).To(Equal(foreign.UID))
+			Expect(secret.Data).To(HaveKeyWithValue("password", []byte("hunter2")))
+			Expect(secret.OwnerReferences).To(BeEmpty())
+		})
+
+		It("recreates the secret when the service account is recreated", func() {
+			sa := createServiceAccount("app", annotations())
+			_, err := reconcileServiceAccount(sa)
+			Expect(err).NotTo(HaveOccurred())
+			stale := getSecret(sa)
+
+			// envtest runs no garbage collector, the secret of the deleted service account is left behind
+			Expect(k8sClient.Delete(ctx, sa)).To(Succeed())
+			recreated := createServiceAccount("app", annotations())
+			Expect(recreated.UID).NotTo(Equal(sa.UID))
+
+			_, err = reconcileServiceAccount(recreated)
+			Expect(err).NotTo(HaveOccurred())
+
+			secret := getSecret(recreated)
+			Expect(secret.UID).NotTo(Equal(stale.UID))
+			expectOwnedBy(secret, recreated)
+			expectEvent("StaleSecret")
+		})
+
+		It("recreates an unlabelled secret left by a previous service account", func() {
+			// as written by the operator before it labelled its secrets
+			stale := &corev1.Secret{
+				ObjectMeta: metav1.ObjectMeta{
+					Name:        TokenSecretName("app"),
+					Namespace:   namespace,
+					Annotations: map[string]string{"kubernetes.io/service-account.name": "app"},
+					OwnerReferences: []metav1.OwnerReference{{
+						APIVersion: "v1",
+						Kind:       "ServiceAccount",
+						Name:       "app",
+						UID:        "previous-uid",
+						Controller: ptr.To(true),
+					}},
+				},
+				Type: corev1.SecretTypeServiceAccountToken,
+			}
+			Expect(k8sClient.Create(ctx, stale)).To(Succeed())
+			sa := createServiceAccount("app", annotations())
+
+			_, err := reconcileServiceAccount(sa)
+			Expect(err).NotTo(HaveOccurred())
+
+			secret := getSecret(sa)
+			Expect(secret.UID).NotTo(Equal(stale.UID))
+			expectOwnedBy(secret, sa)
+			expectEvent("StaleSecret")
+		})
+
+		It("restores the owner reference of its secret", func() {
+			sa := createServiceAccount("app", annotations())
+			_, err := reconcileServiceAccount(sa)
+			Expect(err).NotTo(HaveOccurred())
+
+			disowned := getSecret(sa)
+			disowned.OwnerReferences = nil
+			Expect(k8sClient.Update(ctx, disowned)).To(Succeed())
+
+			_, err = reconcileServiceAccount(sa)
+			Expect(err).NotTo(HaveOccurred())
+
+			secret := getSecret(sa)
+			Expect(secret.UID).To(Equal(disowned.UID))
+			expectOwnedBy(secret, sa)
+			Expect(getServiceAccount(sa).Annotations).NotTo(HaveKey(StatusAnnotation))
+			expectEvent("SecretAdopted")
+		})
+
+		It("reports a resume once", func() {
+			suspended := annotations()
+			suspended[SuspendAnnotation] = "true"
+			sa := createServiceAccount("app", suspended)
+			_, err := reconcileServiceAccount(sa)
+			Expect(err).NotTo(HaveOccurred())
+			Expect(getServiceAccount(sa).Annotations).To(HaveKeyWithValue(StatusAnnotation, statusSuspended))
+			expectNoSecret(sa)
+
+			resumed := getServiceAccount(sa)
+			delete(resumed.Annotations, SuspendAnnotation)
+			Expect(k8sClient.Update(ctx, resumed)).To(Succeed())
+
+			_, err = reconcileServiceAccount(sa)
+			Expect(err).NotTo(HaveOccurred())
+			Expect(getServiceAccount(sa).Annotations).NotTo(HaveKey(StatusAnnotation))
+			expectEvent("Resumed")
+
+			_, err = reconcileServiceAccount(sa)
+			Expect(err).NotTo(HaveOccurred())
+			Expect(recorder.Events).NotTo(Receive(ContainSubstring(" Resumed ")))
+		})
+	})
+
+	Context("in renewal mode", func() {
+		var clk *clocktesting.FakeClock
+
+		BeforeEach(func() {
+			clk = clocktesting.NewFakeClock(time.Now().Truncate(time.Second))
+			reconciler.Clock = clk
+		})
+
+		annotations := func(renewAfter string) map[string]string {
+			return map[string]string{"or.io/renew-after": renewAfter}
+		}
+
+		// the expiration is set by the API server, which runs on the real clock
+		expiration := func(sa *corev1.ServiceAccount) time.Time {
+			expiration, ok := tokenExpiration(getServiceAccount(sa).Annotations)
+			Expect(ok).To(BeTrue(), "expected a token expiration annotation")
+			return expiration
+		}
+
+		It("issues a token and schedules its renewal", func() {
+			sa := createServiceAccount("app", annotations("24h"))
+
+			result, err := reconcileServiceAccount(sa)
+			Expect(err).NotTo(HaveOccurred())
+
+			secret := getSecret(sa)
+			Expect(secret.Type).To(Equal(DefaultRenewalSecretType))
+			Expect(secret.Data).To(HaveKeyWithValue("namespace", []byte(namespace)))
+			Expect(tokenServiceAccountUID(secret.Data["token"])).To(Equal(sa.UID))
+			expectOwnedBy(secret, sa)
+
+			Expect(getServiceAccount(sa).Annotations).To(HaveKeyWithValue("or.io/last-renewal", clk.Now().UTC().Format(time.RFC3339)))
+			Expect(expiration(sa)).To(BeTemporally("~", time.Now().Add(24*time.Hour), time.Minute))
+			Expect(result.RequeueAfter).To(Equal(requeuePeriod(clk.Now(), expiration(sa), 24*time.Hour)))
+		})
+
+		It("keeps the token until its renewal is due", func() {
+			sa := createServiceAccount("app", annotations("24h"))
+			_, err := reconcileServiceAccount(sa)
+			Expect(err).NotTo(HaveOccurred())
+			issued := getSecret(sa).Data["token"]
+
+			clk.Step(time.Hour)
+			result, err := reconcileServiceAccount(sa)
+			Expect(err).NotTo(HaveOccurred())
+			Expect(result.RequeueAfter).To(Equal(requeuePeriod(clk.Now(), expiration(sa), 24*time.Hour)))
+			Expect(getSecret(sa).Data["token"]).To(Equal(issued))
+		})
+
+		It("renews the token when reconciled at the scheduled time", func() {
+			sa := createServiceAccount("app", annotations("24h"))
+			result, err := reconcileServiceAccount(sa)
+			Expect(err).NotTo(HaveOccurred())
+			issued := getSecret(sa).Data["token"]
+
+			clk.Step(result.RequeueAfter)
+			_, err = reconcileServiceAccount(sa)
+			Expect(err).NotTo(HaveOccurred())
+
+			Expect(getSecret(sa).Data["token"]).NotTo(Equal(issued))
+			Expect(getServiceAccount(sa).Annotations).To(HaveKeyWithValue("or.io/last-renewal", clk.Now().UTC().Format(time.RFC3339)))
+		})
+
+		It("replaces the renewal secret with a long-lived token when switched to long-lived mode", func() {
+			sa := createServiceAccount("app", annotations("24h"))
+			_, err := reconcileServiceAccount(sa)
+			Expect(err).NotTo(HaveOccurred())
+			renewed := getSecret(sa)
+
+			switched := getServiceAccount(sa)
+			delete(switched.Annotations, "or.io/renew-after")
+			switched.Annotations["or.io/create-secret"] = "true"
+			Expect(k8sClient.Update(ctx, switched)).To(Succeed())
+
+			_, err = reconcileServiceAccount(sa)
+			Expect(err).NotTo(HaveOccurred())
+
+			secret := getSecret(sa)
+			Expect(secret.UID).NotTo(Equal(renewed.UID))
+			Expect(secret.Type).To(Equal(corev1.SecretTypeServiceAccountToken))
+			Expect(secret.Annotations).To(HaveKeyWithValue(secretModeAnnotation, ModeLongLived))
+			expectOwnedBy(secret, sa)
+		})
+
+		It("removes a status written with Update before server-side apply", func() {
+			sa := createServiceAccount("app", annotations("24h"))
+			sa.Annotations[StatusAnnotation] = "Failed: the token could not be issued"
+			Expect(k8sClient.Update(ctx, sa, client.FieldOwner(legacyFieldManager))).To(Succeed())
+
+			_, err := reconcileServiceAccount(sa)
+			Expect(err).NotTo(HaveOccurred())
+
+			current := getServiceAccount(sa)
+			Expect(current.Annotations).NotTo(HaveKey(StatusAnnotation))
+			Expect(current.ManagedFields).NotTo(ContainElement(HaveField("Manager", legacyFieldManager)))
+		})
+
+		It("deletes the secrets of named tokens once the annotation is removed", func() {
+			sa := createServiceAccount("app", map[string]string{
+				"or.io/renew-after":   "24h",
+				NamedTokensAnnotation: "[{name: ci, lifetime: 1h}]",
+			})
+			_, err := reconcileServiceAccount(sa)
+			Expect(err).NotTo(HaveOccurred())
+			named := client.ObjectKey{Namespace: namespace, Name: namedTokenSecretName(sa.Name, "ci")}
+			Expect(k8sClient.Get(ctx, named, &corev1.Secret{})).To(Succeed())
+
+			sa = getServiceAccount(sa)
+			delete(sa.Annotations, NamedTokensAnnotation)
+			Expect(k8sClient.Update(ctx, sa)).To(Succeed())
+
+			_, err = reconcileServiceAccount(sa)
+			Expect(err).NotTo(HaveOccurred())
+			err = k8sClient.Get(ctx, named, &corev1.Secret{})
+			Expect(apierrors.IsNotFound(err)).To(BeTrue(), "expected the named token secret to be deleted, got %v", err)
+			Expect(getSecret(sa).Data).To(HaveKey("token"))
+		})
+
+		It("reissues the token when the service account is recreated", func() {
+			sa := createServiceAccount("app", annotations("24h"))
+			_, err := reconcileServiceAccount(sa)
+			Expect(err).NotTo(HaveOccurred())
+
+			Expect(k8sClient.Delete(ctx, sa)).To(Succeed())
+			recreated := createServiceAccount("app", annotations("24h"))
+
+			_, err = reconcileServiceAccount(recreated)
+			Expect(err).NotTo(HaveOccurred())
+
+			secret := getSecret(recreated)
+			expectOwnedBy(secret, recreated)
+			Expect(tokenServiceAccountUID(secret.Data["token"])).To(Equal(recreated.UID))
+		})
+
+		It("refuses to overwrite a secret it does not own", func() {
+			foreign := &corev1.Secret{
+				ObjectMeta: metav1.ObjectMeta{Name: TokenSecretName("app"), Namespace: namespace},
+				StringData: map[string]string{"token": "not-a-token"},
+			}
+			Expect(k8sClient.Create(ctx, foreign)).To(Succeed())
+			sa := createServiceAccount("app", annotations("24h"))
+
+			_, err := reconcileServiceAccount(sa)
+			Expect(err).NotTo(HaveOccurred())
+
+			Expect(getServiceAccount(sa).Annotations[StatusAnnotation]).To(HavePrefix("Blocked:"))
+			Expect(getSecret(sa).Data).To(HaveKeyWithValue("token", []byte("not-a-token")))
+		})
+
+		DescribeTable("ignores service accounts with invalid annotations",
+			func(annotations map[string]string) {
+				sa := createServiceAccount("app", annotations)
+
+				result, err := reconcileServiceAccount(sa)
+				Expect(err).NotTo(HaveOccurred())
+				Expect(result).To(Equal(ctrl.Result{}))
+
+				expectNoSecret(sa)
+				Expect(getServiceAccount(sa).Annotations).NotTo(HaveKey("or.io/token-expiration"))
+			},
+			Entry("unparseable renewal period", map[string]string{"or.io/renew-after": "tomorrow"}),
+			Entry("renewal period below the TokenRequest minimum", map[string]string{"or.io/renew-after": "5m"}),
+			Entry("malformed named tokens", map[string]string{"or.io/renew-after": "24h", NamedTokensAnnotation: "[{"}),
+		)
+
+		It("denies a renewal period below the minimum of the policy", func() {
+			sa := createServiceAccount("app", annotations("1h"))
+
+			_, err := reconcileServiceAccount(sa)
+			Expect(err).NotTo(HaveOccurred())
+
+			expectNoSecret(sa)
+			Expect(getServiceAccount(sa).Annotations[StatusAnnotation]).To(HavePrefix("Denied:"))
+		})
+	})
+
+	// The operator runs as a user allowed to manage service accounts and secrets but not to
+	// request tokens, as when the serviceaccounts/token rule is dropped from its role.
+	Context("without the permission to request tokens", func() {
+		var restrictedClient client.Client
+
+		BeforeEach(func() {
+			username := "restricted-" + namespace
+			user, err := testEnv.AddUser(envtest.User{Name: username}, cfg)
+			Expect(err).NotTo(HaveOccurred())
+			restrictedClient, err = client.New(user.Config(), client.Options{Scheme: scheme.Scheme})
+			Expect(err).NotTo(HaveOccurred())
+
+			role := &rbacv1.ClusterRole{
+				ObjectMeta: metav1.ObjectMeta{Name: username},
+				Rules: []rbacv1.PolicyRule{
+					{APIGroups: []string{""}, Resources: []string{"serviceaccounts"}, Verbs: []string{"get", "list", "watch", "patch"}},
+					{APIGroups: []string{""}, Resources: []string{"secrets"}, Verbs: []string{"get", "list", "watch", "create", "patch", "delete"}},
+					{APIGroups: []string{""}, Resources: []string{"events"}, Verbs: []string{"create", "patch"}},
+				},
+			}
+			Expect(k8sClient.Create(ctx, role)).To(Succeed())
+			binding := &rbacv1.ClusterRoleBinding{
+				ObjectMeta: metav1.ObjectMeta{Name: role.Name},
+				RoleRef:    rbacv1.RoleRef{APIGroup: rbacv1.GroupName, Kind: "ClusterRole", Name: role.Name},
+				Subjects:   []rbacv1.Subject{{APIGroup: rbacv1.GroupName, Kind: rbacv1.UserKind, Name: username}},
+			}
+			Expect(k8sClient.Create(ctx, binding)).To(Succeed())
+			DeferCleanup(func() {
+				Expect(k8sClient.Delete(ctx, binding)).To(Succeed())
+				Expect(k8sClient.Delete(ctx, role)).To(Succeed())
+			})
+
+			// the authorizer of the API server picks up the binding asynchronously
+			Eventually(func() (bool, error) {
+				return allowed(ctx, restrictedClient, permission{resource: "secrets", verb: "create"})
+			}).Should(BeTrue())
+
+			reconciler.Client = restrictedClient
+		})
+
+		It("still manages long-lived tokens", func() {
+			sa := createServiceAccount("app", map[string]string{"or.io/create-secret": "true"})
+
+			_, err := reconcileServiceAccount(sa)
+			Expect(err).NotTo(HaveOccurred())
+			expectOwnedBy(getSecret(sa), sa)
+		})
+
+		It("fails renewals permanently", func() {
+			sa := createServiceAccount("app", map[string]string{"or.io/renew-after": "24h"})
+
+			_, err := reconcileServiceAccount(sa)
+			Expect(errors.Is(err, reconcile.TerminalError(nil))).To(BeTrue(), "expected a terminal error, got %v", err)
+			Expect(apierrors.IsForbidden(err)).To(BeTrue(), "expected a forbidden error, got %v", err)
+
+			expectNoSecret(sa)
+			Expect(getServiceAccount(sa).Annotations[StatusAnnotation]).To(HavePrefix("Failed:"))
+			expectEvent("RenewalFailed")
+		})
+
+		It("disables renewal mode once the permission check ran", func() {
+			reconciler.Permissions = &PermissionCheck{}
+			Expect(reconciler.Permissions.Run(ctx, restrictedClient, logr.Discard())).To(Succeed())
+			Expect(reconciler.Permissions.Missing(ModeRenewal)).To(ConsistOf("create serviceaccounts/token"))
+			Expect(reconciler.Permissions.Missing(ModeLongLived)).To(BeEmpty())
+
+			sa := createServiceAccount("app", map[string]string{"or.io/renew-after": "24h"})
+
+			_, err := reconcileServiceAccount(sa)
+			Expect(err).NotTo(HaveOccurred())
+
+			expectNoSecret(sa)
+			Expect(getServiceAccount(sa).Annotations[StatusAnnotation]).To(HavePrefix("Disabled:"))
+			expectEvent("ModeDisabled")
+		})
+	})
+})
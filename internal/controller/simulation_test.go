@@ -0,0 +1,420 @@
+package controller
+
+import (
+	"cmp"
+	"context"
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"math/rand/v2"
+	"slices"
+	"testing"
+	"time"
+
+	"github.com/go-logr/logr"
+	authenticationv1 "k8s.io/api/authentication/v1"
+	corev1 "k8s.io/api/core/v1"
+	apierrors "k8s.io/apimachinery/pkg/api/errors"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/runtime"
+	"k8s.io/apimachinery/pkg/types"
+	"k8s.io/apimachinery/pkg/util/validation/field"
+	clientgoscheme "k8s.io/client-go/kubernetes/scheme"
+	clocktesting "k8s.io/utils/clock/testing"
+	ctrl "sigs.k8s.io/controller-runtime"
+	"sigs.k8s.io/controller-runtime/pkg/client"
+	"sigs.k8s.io/controller-runtime/pkg/client/fake"
+	"sigs.k8s.io/controller-runtime/pkg/client/interceptor"
+)
+
+// simulation fast-forwards a fake clock from one requested reconciliation to the next. The fake
+// client does not support server-side apply, it is emulated.
+type simulation struct {
+	t          *testing.T
+	ctx        context.Context
+	clock      *clocktesting.FakeClock
+	client     client.Client
+	reconciler *ServiceAccountReconciler
+	rand       *rand.Rand
+	// maxTokenLifetime caps the lifetime of the issued tokens
+	maxTokenLifetime time.Duration
+
+	// expirations of the issued tokens, by token
+	expirations map[string]time.Time
+	// issued counts the tokens issued by service account
+	issued map[types.NamespacedName]int
+	// next is when each service account is reconciled next, missing when it is not requeued
+	next map[types.NamespacedName]time.Time
+	keys []types.NamespacedName
+	uids int
+}
+
+func newSimulation(t *testing.T, start time.Time, policy *Policy, maxTokenLifetime time.Duration) *simulation {
+	s := &simulation{
+		t:                t,
+		maxTokenLifetime: maxTokenLifetime,
+		ctx:              ctrl.LoggerInto(context.Background(), logr.Discard()),
+		clock:            clocktesting.NewFakeClock(start),
+		rand:             rand.New(rand.NewPCG(1, 2)),
+		expirations:      map[string]time.Time{},
+		issued:           map[types.NamespacedName]int{},
+		next:             map[types.NamespacedName]time.Time{},
+	}
+
+	scheme := runtime.NewScheme()
+	if err := clientgoscheme.AddToScheme(scheme); err != nil {
+		t.Fatal(err)
+	}
+
+	s.client = fake.NewClientBuilder().
+		WithScheme(scheme).
+		WithInterceptorFuncs(interceptor.Funcs{
+			Patch:             s.patch,
+			SubResourceCreate: s.subResourceCreate,
+		}).
+		Build()
+
+	s.reconciler = &ServiceAccountReconciler{
+		Client: s.client,
+		Scheme: scheme,
+		Policy: policy,
+		Clock:  s.clock,
+	}
+
+	return s
+}
+
+func (s *simulation) uid() types.UID {
+	s.uids++
+	return types.UID(fmt.Sprintf("00000000-0000-0000-0000-%012d", s.uids))
+}
+
+// patch only emulates server-side apply for the fields the operator applies.
+func (s *simulation) patch(ctx context.Context, c client.WithWatch, obj client.Object, patch client.Patch, opts ...client.PatchOption) error {
+	if patch.Type() != types.ApplyPatchType {
+		return c.Patch(ctx, obj, patch, opts...)
+	}
+
+	switch applied := obj.(type) {
+	case *corev1.Secret:
+		existing := &corev1.Secret{}
+		if err := c.Get(ctx, client.ObjectKeyFromObject(applied), existing); apierrors.IsNotFound(err) {
+			applied.UID = s.uid()
+			return c.Create(ctx, applied)
+		} else if err != nil {
+			return err
+		}
+
+		if applied.Type != "" && applied.Type != existing.Type {
+			return apierrors.NewInvalid(corev1.SchemeGroupVersion.WithKind("Secret").GroupKind(), applied.Name,
+				field.ErrorList{field.Invalid(field.NewPath("type"), applied.Type, "field is immutable")})
+		}
+
+		existing.Labels = mergeMaps(existing.Labels, applied.Labels)
+		existing.Annotations = mergeMaps(existing.Annotations, applied.Annotations)
+		if applied.OwnerReferences != nil {
+			existing.OwnerReferences = applied.OwnerReferences
+		}
+		if applied.Data != nil {
+			existing.Data = applied.Data
+		}
+		if err := c.Update(ctx, existing); err != nil {
+			return err
+		}
+		existing.DeepCopyInto(applied)
+	case *corev1.ServiceAccount:
+		existing := &corev1.ServiceAccount{}
+		if err := c.Get(ctx, client.ObjectKeyFromObject(applied), existing); err != nil {
+			return err
+		}
+
+		for _, key := range operatorAnnotations {
+			delete(existing.Annotations, key)
+		}
+		existing.Annotations = mergeMaps(existing.Annotations, applied.Annotations)
+		if err := c.Update(ctx, existing); err != nil {
+			return err
+		}
+		existing.DeepCopyInto(applied)
+	default:
+		return fmt.Errorf("apply of %T is not emulated", obj)
+	}
+
+	return nil
+}
+
+func mergeMaps(dst, src map[string]string) map[string]string {
+	if dst == nil {
+		dst = map[string]string{}
+	}
+	for k, v := range src {
+		dst[k] = v
+	}
+	return dst
+}
+
+// subResourceCreate caps the lifetimes like --service-account-max-token-expiration.
+func (s *simulation) subResourceCreate(ctx context.Context, c client.Client, subResourceName string, obj client.Object, subResource client.Object, opts ...client.SubResourceCreateOption) error {
+	tokenReq, ok := subResource.(*authenticationv1.TokenRequest)
+	if subResourceName != "token" || !ok {
+		return c.SubResource(subResourceName).Create(ctx, obj, subResource, opts...)
+	}
+
+	sa := &corev1.ServiceAccount{}
+	if err := c.Get(ctx, client.ObjectKeyFromObject(obj), sa); err != nil {
+		return err
+	}
+
+	key := client.ObjectKeyFromObject(sa)
+	s.issued[key]++
+	expiration := s.clock.Now().Add(min(time.Duration(*tokenReq.Spec.ExpirationSeconds)*time.Second, s.maxTokenLifetime))
+
+	claims, err := json.Marshal(map[string]any{
+		"exp":           expiration.Unix(),
+		"kubernetes.io": map[string]any{"serviceaccount": map[string]any{"name": sa.Name, "uid": sa.UID}},
+		// tokens of the same service account have to differ
+		"jti": fmt.Sprintf("%s-%d", key, s.issued[key]),
+	})
+	if err != nil {
+		return err
+	}
+	token := fmt.Sprintf("e30.%s.c2ln", base64.RawURLEncoding.EncodeToString(claims))
+
+	s.expirations[token] = expiration
+	tokenReq.Status = authenticationv1.TokenRequestStatus{Token: token, ExpirationTimestamp: metav1.NewTime(expiration)}
+
+	return nil
+}
+
+// addServiceAccount creates the service account in its own namespace, so its secrets are listed quickly.
+func (s *simulation) addServiceAccount(namespace string, annotations map[string]string) types.NamespacedName {
+	sa := &corev1.ServiceAccount{
+		ObjectMeta: metav1.ObjectMeta{Name: "app", Namespace: namespace, UID: s.uid(), Annotations: annotations},
+	}
+	if err := s.client.Create(s.ctx, sa); err != nil {
+		s.t.Fatal(err)
+	}
+
+	key := client.ObjectKeyFromObject(sa)
+	s.next[key] = s.clock.Now()
+	s.keys = append(s.keys, key)
+
+	return key
+}
+
+// requestRotation sets the rotation trigger, the watch reconciles the service account right away.
+func (s *simulation) requestRotation(key types.NamespacedName) {
+	sa := &corev1.ServiceAccount{}
+	if err := s.client.Get(s.ctx, key, sa); err != nil {
+		s.t.Fatal(err)
+	}
+
+	patch := client.MergeFrom(sa.DeepCopy())
+	sa.Annotations[RotateAnnotation] = s.clock.Now().Format(time.RFC3339)
+	if err := s.client.Patch(s.ctx, sa, patch); err != nil {
+		s.t.Fatal(err)
+	}
+
+	s.next[key] = s.clock.Now()
+}
+
+// restart reconciles every service account right away, as the initial list of a restarted operator does.
+func (s *simulation) restart() {
+	for _, key := range s.keys {
+		s.next[key] = s.clock.Now()
+	}
+}
+
+// tokens returns the expirations of the tokens held by the secrets of the service account.
+func (s *simulation) tokens(key types.NamespacedName) map[string]time.Time {
+	secrets := &corev1.SecretList{}
+	if err := s.client.List(s.ctx, secrets, client.InNamespace(key.Namespace), client.MatchingLabels{ManagedByLabel: ManagedByValue}); err != nil {
+		s.t.Fatal(err)
+	}
+
+	tokens := map[string]time.Time{}
+	for _, secret := range secrets.Items {
+		if secret.Name != TokenSecretName(key.Name) && secret.Labels[serviceAccountLabel] != key.Name {
+			continue
+		}
+		// long-lived secrets get their token from the token controller
+		if token, ok := secret.Data["token"]; ok {
+			expiration, ok := s.expirations[string(token)]
+			if !ok {
+				s.t.Fatalf("secret %s holds a token that was never issued", secret.Name)
+			}
+			tokens[secret.Name] = expiration
+		}
+	}
+
+	return tokens
+}
+
+// reconcile checks that the service account is requeued before any of its tokens expires.
+func (s *simulation) reconcile(key types.NamespacedName) {
+	now := s.clock.Now()
+
+	result, err := s.reconciler.Reconcile(s.ctx, ctrl.Request{NamespacedName: key})
+	if err != nil {
+		s.t.Fatalf("%s: reconciliation of %s failed: %v", now, key, err)
+	}
+
+	delete(s.next, key)
+	if result.RequeueAfter > 0 {
+		s.next[key] = now.Add(result.RequeueAfter)
+	}
+
+	for name, expiration := range s.tokens(key) {
+		if !expiration.After(now) {
+			s.t.Fatalf("%s: token of secret %s expired at %s", now, name, expiration)
+		}
+		if next, ok := s.next[key]; !ok || !next.Before(expiration) {
+			s.t.Fatalf("%s: token of secret %s expires at %s but %s is requeued at %s", now, name, expiration, key, next)
+		}
+	}
+}
+
+// run delays each reconciliation by up to maxDelay, as busy workers would.
+func (s *simulation) run(end time.Time, maxDelay time.Duration, before func(now time.Time)) {
+	for {
+		keys := make([]types.NamespacedName, 0, len(s.next))
+		for key := range s.next {
+			keys = append(keys, key)
+		}
+		if len(keys) == 0 {
+			return
+		}
+
+		key := slices.MinFunc(keys, func(a, b types.NamespacedName) int {
+			if c := s.next[a].Compare(s.next[b]); c != 0 {
+				return c
+			}
+			return cmp.Or(cmp.Compare(a.Namespace, b.Namespace), cmp.Compare(a.Name, b.Name))
+		})
+
+		at := s.next[key]
+		if maxDelay > 0 {
+			at = at.Add(time.Duration(s.rand.Int64N(int64(maxDelay))))
+		}
+		if at.After(end) {
+			return
+		}
+		if at.After(s.clock.Now()) {
+			s.clock.SetTime(at)
+		}
+
+		if before != nil {
+			before(s.clock.Now())
+		}
+		s.reconcile(key)
+	}
+}
+
+// TestSimulatedRenewals checks over three weeks that no token lapses or is renewed too often.
+func TestSimulatedRenewals(t *testing.T) {
+	start := time.Date(2025, 1, 6, 9, 0, 0, 0, time.UTC)
+	duration := 21 * 24 * time.Hour
+	// reconciliations are delayed by up to 20s, less than the requeue margin of the shortest tokens
+	maxDelay := 20 * time.Second
+
+	// 7 day tokens are issued for 48h only
+	maxTokenLifetime := 48 * time.Hour
+
+	s := newSimulation(t, start, &Policy{MinRenewalPeriod: &metav1.Duration{Duration: minTokenRequestLifetime}}, maxTokenLifetime)
+
+	lifetimes := []time.Duration{10 * time.Minute, time.Hour, 90 * time.Minute, 24 * time.Hour, 7 * 24 * time.Hour}
+	// a token is renewed at the earliest renewalThreshold before it expires
+	renewals := func(lifetime time.Duration) int {
+		issued := min(lifetime, maxTokenLifetime)
+		return int(duration/(issued-renewalThreshold(lifetime))) + 1
+	}
+
+	type managed struct {
+		key types.NamespacedName
+		// tokens is the number of tokens of the service account
+		tokens int
+		// renewals is the number of tokens the service account may need over the simulation
+		renewals int
+	}
+	var all []managed
+
+	for i := range 25 {
+		lifetime := lifetimes[i%len(lifetimes)]
+		annotations := map[string]string{}
+		m := managed{}
+
+		switch i / len(lifetimes) {
+		case 0, 1:
+			annotations["or.io/renew-after"] = lifetime.String()
+			m.tokens, m.renewals = 1, renewals(lifetime)
+		case 2:
+			annotations[NamedTokensAnnotation] = fmt.Sprintf(`[{"name": "api", "lifetime": %q}, {"name": "metrics", "lifetime": "2h"}]`, lifetime)
+			m.tokens, m.renewals = 2, renewals(lifetime)+renewals(2*time.Hour)
+		case 3:
+			annotations["or.io/renew-after"] = lifetime.String()
+			annotations[NamedTokensAnnotation] = fmt.Sprintf(`[{"name": "api", "lifetime": %q}]`, lifetime)
+			m.tokens, m.renewals = 2, 2*renewals(lifetime)
+		default:
+			annotations["or.io/create-secret"] = "true"
+		}
+
+		m.key = s.addServiceAccount(fmt.Sprintf("team-%02d", i), annotations)
+		all = append(all, m)
+	}
+
+	rotated := map[types.NamespacedName]bool{}
+	restarted := false
+	s.run(start.Add(duration), maxDelay, func(now time.Time) {
+		elapsed := now.Sub(start)
+
+		if elapsed >= 10*24*time.Hour && len(rotated) == 0 {
+			// every third service account, so each mode and lifetime gets rotated
+			for i := 0; i < len(all); i += 3 {
+				s.requestRotation(all[i].key)
+				rotated[all[i].key] = true
+			}
+		}
+
+		if elapsed >= 17*24*time.Hour && !restarted {
+			s.restart()
+			restarted = true
+		}
+	})
+
+	if len(rotated) == 0 || !restarted {
+		t.Fatal("the simulation ended before the rotations and the restart")
+	}
+
+	for _, m := range all {
+		sa := &corev1.ServiceAccount{}
+		if err := s.client.Get(s.ctx, m.key, sa); err != nil {
+			t.Fatal(err)
+		}
+
+		if status := sa.Annotations[StatusAnnotation]; status != "" {
+			t.Errorf("%s has status %q", m.key, status)
+		}
+		if rotationRequested(sa.Annotations) {
+			t.Errorf("rotation of %s was never handled", m.key)
+		}
+
+		// a rotation reissues every token once
+		limit := m.renewals
+		if rotated[m.key] {
+			limit += m.tokens
+		}
+		if got := s.issued[m.key]; got > limit {
+			t.Errorf("%s got %d tokens, expected at most %d", m.key, got, limit)
+		}
+
+		if ManagementMode(sa.Annotations) == ModeLongLived {
+			if s.issued[m.key] != 0 {
+				t.Errorf("long-lived %s got %d tokens", m.key, s.issued[m.key])
+			}
+			secret := &corev1.Secret{}
+			if err := s.client.Get(s.ctx, types.NamespacedName{Namespace: m.key.Namespace, Name: TokenSecretName(m.key.Name)}, secret); err != nil {
+				t.Errorf("long-lived %s has no secret: %v", m.key, err)
+			}
+		}
+	}
+}
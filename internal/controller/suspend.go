@@ -0,0 +1,47 @@
+package controller
+
+import (
+	"context"
+
+	"github.com/go-logr/logr"
+	corev1 "k8s.io/api/core/v1"
+)
+
+// SuspendAnnotation freezes the token of a service account when set to "true".
+const SuspendAnnotation = "or.io/suspend"
+
+// statusSuspended tells a resume apart from a service account that was never suspended.
+const statusSuspended = "Suspended"
+
+func isSuspended(annotations map[string]string) bool {
+	return annotations[SuspendAnnotation] == "true"
+}
+
+func (r *ServiceAccountReconciler) checkSuspended(ctx context.Context, sa *corev1.ServiceAccount, log logr.Logger) (bool, error) {
+	wasSuspended := sa.Annotations[StatusAnnotation] == statusSuspended
+
+	if !isSuspended(sa.Annotations) {
+		if wasSuspended {
+			// cleared before handling, a failing handler must not report the resume on every retry
+			if err := r.setStatus(ctx, sa, ""); err != nil {
+				return false, err
+			}
+
+			log.Info("resuming management of service account", "name", sa.Name, "namespace", sa.Namespace)
+			suspensionsTotal.WithLabelValues("resume").Inc()
+			recordNormal(r.Recorder, sa, "Resumed", "management of the service account token resumed")
+		}
+		return false, nil
+	}
+
+	if wasSuspended {
+		log.Info("management of service account is suspended, skipping", "name", sa.Name, "namespace", sa.Namespace)
+		return true, nil
+	}
+
+	log.Info("suspending management of service account", "name", sa.Name, "namespace", sa.Namespace)
+	suspensionsTotal.WithLabelValues("suspend").Inc()
+	recordNormal(r.Recorder, sa, "Suspended", "management of the service account token suspended, the token is neither renewed nor recreated")
+
+	return true, r.setStatus(ctx, sa, statusSuspended)
+}